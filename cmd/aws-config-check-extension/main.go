@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/bellyjay1005/aws-config-check-extension/plugin"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-go/plugin/environ"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	// auth0Endpoint represents the Auth0 endpoint URL
+	auth0Endpoint = "https://bellyjay1005-id.auth0.com/oauth/token"
+
+	// defaultAddress is used when PLUGIN_ADDRESS is not set
+	defaultAddress = ":3000"
+)
+
+func main() {
+	logrus.SetFormatter(plugin.NewLogFormatter(os.Getenv("LOG_FORMAT") == "text"))
+	if os.Getenv("PLUGIN_DEBUG") == "true" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	secret := os.Getenv("PLUGIN_SECRET")
+	if secret == "" {
+		logrus.Fatal("missing secret key")
+	}
+	address := os.Getenv("PLUGIN_ADDRESS")
+	if address == "" {
+		address = defaultAddress
+	}
+	env := os.Getenv("ENV")
+	ctx := context.Background()
+
+	// github client, enterprise when a server is set
+	server := os.Getenv("GITHUB_SERVER")
+	token := os.Getenv("GITHUB_TOKEN")
+	client, err := plugin.CreatePublicClient(ctx, server, token)
+	if server != "" {
+		client, err = plugin.CreateEnterpriseClient(ctx, server, token)
+	}
+	if err != nil {
+		logrus.Fatalf("Error creating the github client: %s", err)
+	}
+	ssmClient, _ := plugin.CreateSSMService(os.Getenv("REGION"))
+
+	authEndpoint, host, _ := plugin.ConstructHost(env)
+	if os.Getenv("DRONE_HOST") != "" {
+		host = os.Getenv("DRONE_HOST")
+	}
+
+	settings, err := plugin.LoadSettings(os.Getenv("SETTINGS_FILE"))
+	if err != nil {
+		logrus.Fatalf("Error loading settings: %s", err)
+	}
+	if err := settings.Registry.Fetch(ctx, client); err != nil {
+		logrus.Fatalf("Error loading the account registry: %s", err)
+	}
+	authorizer, err := settings.NewAuthorizer(ctx, authEndpoint, client)
+	if err != nil {
+		logrus.Fatalf("Error loading policy: %s", err)
+	}
+	if _, err := settings.StartTracing(ctx); err != nil {
+		logrus.Fatalf("Error starting tracing: %s", err)
+	}
+	auditor, err := settings.NewAuditor()
+	if err != nil {
+		logrus.Fatalf("Error opening the audit log: %s", err)
+	}
+
+	p := plugin.New(
+		server,
+		token,
+		os.Getenv("DRONE_TOKEN"),
+		host,
+		auth0Endpoint,
+		authEndpoint,
+		os.Getenv("API_ENDPOINT"),
+		os.Getenv("API_ENDPOINT_QA"),
+		ssmClient,
+		client,
+		plugin.WithAuthorizer(authorizer),
+		plugin.WithShadowAuthorizer(settings.NewShadowAuthorizer()),
+		plugin.WithSettings(settings),
+		plugin.WithAuditor(auditor),
+		plugin.WithNotifier(settings.NewNotifier()),
+	)
+
+	// process and go runtime metrics next to the extension ones
+	plugin.Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	http.Handle("/", plugin.RequestIDHandler(
+		otelhttp.NewHandler(config.Handler(p, secret, logrus.StandardLogger()), "config"),
+	))
+	http.Handle("/environ", plugin.RequestIDHandler(
+		otelhttp.NewHandler(environ.Handler(secret, p, logrus.StandardLogger()), "environ"),
+	))
+	http.Handle("/metrics", promhttp.HandlerFor(plugin.Registry, promhttp.HandlerOpts{}))
+	logrus.Infof("server listening on address %s", address)
+	logrus.Fatal(http.ListenAndServe(address, nil))
+}
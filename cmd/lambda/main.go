@@ -6,23 +6,82 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-go/plugin/environ"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	"github.com/bellyjay1005/aws-config-check-extension/plugin"
 )
 
 const (
 	// auth0Endpoint represents the Auth0 endpoint URL
 	auth0Endpoint = "https://bellyjay1005-id.auth0.com/oauth/token"
+
+	// notifyMargin is kept free at the end of an invocation to respond
+	notifyMargin = time.Second
+)
+
+var (
+	// settings, authorizer, auditor, teams and notifier outlive a single
+	// invocation so the auth api circuit breaker, the audit hash chain and
+	// the team lookup cache keep their state while the lambda is warm
+	settings    *plugin.Settings
+	authorizer  plugin.Authorizer
+	auditor     *plugin.Auditor
+	teams       plugin.TeamMembership
+	notifier    *plugin.Notifier
+	flushTraces func(context.Context) error
 )
 
+// waitForNotifications waits for the notifications of this invocation, as
+// lambda freezes anything still running once the handler returns. The wait
+// is capped by the notify wait setting, so slow webhooks barely delay the
+// response, and stops a second before the invocation times out.
+func waitForNotifications(ctx context.Context, log *logrus.Entry) {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-notifyMargin))
+		defer cancel()
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.Notify.WaitTimeout())
+	defer cancel()
+	if err := notifier.Wait(ctx); err != nil {
+		log.Warnf("Notifications still pending at the end of the invocation: %v", err)
+	}
+}
+
+// waitForShadows waits for the shadow comparisons of this invocation so no
+// disagreement is lost when lambda freezes. The candidate call is bounded by
+// the shadow timeout, and the wait by the same.
+func waitForShadows(ctx context.Context, p *plugin.Plugin, log *logrus.Entry) {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-notifyMargin))
+		defer cancel()
+	}
+	ctx, cancel := context.WithTimeout(ctx, settings.Shadow.WaitTimeout())
+	defer cancel()
+	if err := p.WaitShadows(ctx); err != nil {
+		log.Warnf("Shadow comparisons still pending at the end of the invocation: %v", err)
+	}
+}
+
 // HandleRequest handles the input from lambda
 func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// correlate every log line of this invocation
+	requestID := plugin.LambdaRequestID(req)
+	ctx = plugin.WithRequestID(ctx, requestID)
+	log := logrus.WithField("request_id", requestID)
+
 	// initialize variables
-	logrus.Debugf("Initializing function variables")
+	log.Debugf("Initializing function variables")
+	defer plugin.FlushEMF(os.Stdout)
 	var tokenLocation string
 	body := req.Body
 	droneReq := &config.Request{}
@@ -39,12 +98,12 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (even
 	if os.Getenv("LOGLEVEL") == "DEBUG" {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	logrus.Debugf("Context %v\nRequest%v\n", ctx, req)
+	log.Debugf("Request %s %s", req.HTTPMethod, req.Path)
 
 	// check target github server base URL
 	server, err := plugin.GetGithubServer(req)
 	if err != nil {
-		logrus.Errorf("Wrong Github server domain endpoint. Check your Drone CI configurations - %s", err)
+		log.Errorf("Wrong Github server domain endpoint. Check your Drone CI configurations - %s", err)
 	}
 
 	// return github API client and token
@@ -59,6 +118,46 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (even
 	// get auth-endpoint and host name
 	authEndpoint, host, _ := plugin.ConstructHost(env)
 
+	// load the extension settings and pick the policy engine
+	plugin.CountCache("settings", settings != nil)
+	if settings == nil {
+		settings, err = plugin.LoadSettings(os.Getenv("SETTINGS_FILE"))
+		if err != nil {
+			return plugin.HTTPError(fmt.Sprintf("Error loading settings: %s", err), 500), nil
+		}
+		if err := settings.Registry.Fetch(ctx, client); err != nil {
+			settings = nil
+			return plugin.HTTPError(fmt.Sprintf("Error loading the account registry: %s", err), 500), nil
+		}
+	}
+	if authorizer == nil {
+		authorizer, err = settings.NewAuthorizer(ctx, authEndpoint, client)
+		if err != nil {
+			return plugin.HTTPError(fmt.Sprintf("Error loading policy: %s", err), 500), nil
+		}
+	}
+	if flushTraces == nil {
+		flushTraces, err = settings.StartTracing(ctx)
+		if err != nil {
+			return plugin.HTTPError(fmt.Sprintf("Error starting tracing: %s", err), 500), nil
+		}
+	}
+	defer flushTraces(ctx)
+	if auditor == nil {
+		auditor, err = settings.NewAuditor()
+		if err != nil {
+			return plugin.HTTPError(fmt.Sprintf("Error opening the audit log: %s", err), 500), nil
+		}
+	}
+
+	if teams == nil {
+		teams = settings.NewTeamMembership(client)
+	}
+	if notifier == nil {
+		notifier = settings.NewNotifier()
+	}
+	defer waitForNotifications(ctx, log)
+
 	// declare plugin method
 	p := plugin.New(
 		server,
@@ -71,12 +170,19 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (even
 		os.Getenv("API_ENDPOINT_QA"),
 		ssmClient,
 		client,
+		plugin.WithAuthorizer(authorizer),
+		plugin.WithShadowAuthorizer(settings.NewShadowAuthorizer()),
+		plugin.WithSettings(settings),
+		plugin.WithAuditor(auditor),
+		plugin.WithTeamMembership(teams),
+		plugin.WithNotifier(notifier),
 	)
+	defer waitForShadows(ctx, p, log)
 
 	// HTTP handling stuff from drone-go/handler.go
 	signature, errorValue := plugin.FromRequest(req)
 	if errorValue != nil {
-		logrus.Error("config: invalid or missing signature in Request. Error - ", errorValue)
+		log.Error("config: invalid or missing signature in Request. Error - ", errorValue)
 	}
 
 	// re-add header capitalization
@@ -85,27 +191,35 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (even
 		Header: http.Header(combinedHeaders),
 	}
 
-	logrus.Debugf("Secret location: %v", secretLocation)
+	log.Debugf("Secret location: %v", secretLocation)
 	token, err = plugin.GetSSMParam(region, secretLocation)
 	if err != nil {
 		return plugin.HTTPError("Error connecting to ssm", 500), nil
 	}
 	// handle validation of signature
 	if !signature.IsValid(token, &r) {
-		logrus.Debug("config: invalid signature in http.Request")
+		log.Debug("config: invalid signature in http.Request")
 		return plugin.HTTPError("Invalid Signature", 400), nil
 	}
 
+	// continue the trace started by the caller, if any
+	traceCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+
+	// environ extension requests are sent to the /environ path
+	if strings.HasSuffix(req.Path, "/environ") {
+		return handleEnviron(traceCtx, p, body, r.Header)
+	}
+
 	err = json.Unmarshal([]byte(body), droneReq)
 	if err != nil {
-		logrus.Debug("config: cannot unmarshal http.Request body")
+		log.Debug("config: cannot unmarshal http.Request body")
 		return plugin.HTTPError("Invalid Input", 400), nil
 	}
 
 	// get and validate .strithon.yml config file
-	res, err := p.Find(r.Context(), droneReq)
+	res, err := p.Find(traceCtx, droneReq)
 	if err != nil {
-		logrus.Debugf("config: cannot find configuration: %s: %s: %s",
+		log.Debugf("config: cannot find configuration: %s: %s: %s",
 			droneReq.Repo.Slug,
 			droneReq.Build.Target,
 			err,
@@ -126,6 +240,36 @@ func HandleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (even
 	}, nil
 }
 
+// handleEnviron answers an environ extension request with the variables
+// taken from .strithon.yml
+func handleEnviron(ctx context.Context, p *plugin.Plugin, body string, header http.Header) (events.APIGatewayProxyResponse, error) {
+	environReq := &environ.Request{}
+	if err := json.Unmarshal([]byte(body), environReq); err != nil {
+		logrus.Debug("environ: cannot unmarshal http.Request body")
+		return plugin.HTTPError("Invalid Input", 400), nil
+	}
+	vars, err := p.List(ctx, environReq)
+	if err != nil {
+		return plugin.HTTPError(err.Error(), 404), nil
+	}
+	out, _ := json.Marshal(vars)
+	// v1 clients expect a map of names to values
+	if header.Get("Accept") == environ.V1 {
+		out, _ = json.Marshal(plugin.EnvironMap(vars))
+	}
+	return events.APIGatewayProxyResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body:       string(out),
+		StatusCode: 200,
+	}, nil
+}
+
 func main() {
+	logrus.SetFormatter(plugin.NewLogFormatter(os.Getenv("LOG_FORMAT") == "text"))
+	// metrics are written to the function logs as CloudWatch embedded
+	// metric format after each invocation
+	plugin.EnableEMF()
 	lambda.Start(HandleRequest)
 }
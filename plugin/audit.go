@@ -0,0 +1,355 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// auditConfig is recorded once for every config request
+	auditConfig = "config"
+
+	// auditShadow is recorded when the candidate policy disagrees
+	auditShadow = "shadow-disagreement"
+
+	// defaultWebhookTimeout bounds a webhook delivery when no timeout is set
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// Decisions recorded in the audit log
+const (
+	auditAllowed   = "allowed"
+	auditDenied    = "denied"
+	auditWouldDeny = "would-deny"
+	auditFailOpen  = "fail-open"
+	auditUnchecked = "unchecked"
+	auditInvalid   = "invalid"
+	auditMissing   = "missing"
+	auditError     = "error"
+)
+
+// AuditEvent is a structured record of a decision made by the extension. It
+// names the secrets handed to a build but never holds their values.
+type AuditEvent struct {
+	Time         time.Time `json:"time"`
+	Kind         string    `json:"kind"`
+	Repo         string    `json:"repo"`
+	Commit       string    `json:"commit,omitempty"`
+	Sender       string    `json:"sender,omitempty"`
+	Event        string    `json:"event,omitempty"`
+	Environments []string  `json:"environments,omitempty"`
+	Accounts     []string  `json:"accounts,omitempty"`
+	Denied       []string  `json:"denied,omitempty"`
+	Decision     string    `json:"decision"`
+	DecisionID   string    `json:"decision_id,omitempty"`
+	Reasons      []string  `json:"reasons,omitempty"`
+	FailOpen     []string  `json:"fail_open,omitempty"`
+	Secrets      []string  `json:"secrets,omitempty"`
+	Steps        []string  `json:"steps,omitempty"`
+	// Generated are the deploy steps added from .strithon.yml
+	Generated []string `json:"generated,omitempty"`
+	// Guardrails are the guardrail violations of the pipelines
+	Guardrails []string `json:"guardrails,omitempty"`
+	// Mirrored are the images rewritten to a mirror, as "from -> to"
+	Mirrored  []string        `json:"mirrored,omitempty"`
+	Candidate *AuditCandidate `json:"candidate,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	// Previous is the hash of the record before this one
+	Previous string `json:"previous"`
+	// Hash covers this record, Previous included
+	Hash string `json:"hash"`
+}
+
+// AuditCandidate is the answer of the candidate policy in a shadow
+// disagreement
+type AuditCandidate struct {
+	DecisionID string   `json:"decision_id,omitempty"`
+	Allowed    bool     `json:"allowed"`
+	Denials    []string `json:"denials,omitempty"`
+}
+
+// newAuditEvent starts an event for a config request
+func newAuditEvent(kind string, req *config.Request) *AuditEvent {
+	return &AuditEvent{
+		Kind:     kind,
+		Repo:     req.Repo.Slug,
+		Commit:   req.Build.After,
+		Sender:   req.Build.Sender,
+		Event:    req.Build.Event,
+		Decision: auditUnchecked,
+	}
+}
+
+// setDecision copies the policy decision into the event
+func (e *AuditEvent) setDecision(d *Decision, mode string) {
+	if d == nil {
+		return
+	}
+	e.Environments = d.Environments
+	e.Accounts = d.Requested
+	e.Denied = d.Accounts()
+	e.DecisionID = d.ID
+	e.Reasons = d.Reasons()
+	e.FailOpen = d.FailOpen
+	switch {
+	case !d.Allowed && mode == enforcementAudit:
+		e.Decision = auditWouldDeny
+	case !d.Allowed:
+		e.Decision = auditDenied
+	case len(d.FailOpen) > 0:
+		e.Decision = auditFailOpen
+	default:
+		e.Decision = auditAllowed
+	}
+}
+
+// AuditSink receives each audit record as a single JSON line
+type AuditSink interface {
+	Write(record []byte) error
+}
+
+// lastHasher is implemented by sinks that can resume an existing chain
+type lastHasher interface {
+	LastHash() string
+}
+
+// remoteSink is implemented by sinks that deliver over the network. They
+// are written outside the chain lock so a slow one never holds up others.
+type remoteSink interface {
+	remote()
+}
+
+// Auditor hash-chains audit events and hands them to its sinks. A nil
+// Auditor records nothing.
+type Auditor struct {
+	mu    sync.Mutex
+	sinks []AuditSink
+	last  string
+}
+
+// NewAuditor returns an Auditor writing to the sinks. The chain resumes from
+// the first sink that already holds records.
+func NewAuditor(sinks ...AuditSink) *Auditor {
+	a := &Auditor{sinks: sinks}
+	for _, sink := range sinks {
+		if h, ok := sink.(lastHasher); ok && h.LastHash() != "" {
+			a.last = h.LastHash()
+			break
+		}
+	}
+	return a
+}
+
+// Record chains the event to the previous one and writes it to every sink.
+// A failing sink is logged and does not stop the others.
+func (a *Auditor) Record(e *AuditEvent) {
+	if a == nil || e == nil {
+		return
+	}
+	record, err := a.chain(e)
+	if err != nil {
+		logrus.Errorf("Unable to hash audit record: %v", err)
+		return
+	}
+	for _, sink := range a.sinks {
+		if _, ok := sink.(remoteSink); !ok {
+			continue
+		}
+		if err := sink.Write(record); err != nil {
+			logrus.Errorf("Unable to write audit record: %v", err)
+		}
+	}
+}
+
+// chain hashes the event onto the chain and writes it to the local sinks,
+// in chain order. The chain only moves on once every local sink holds the
+// record, so a failed write leaves no gap before the next record.
+func (a *Auditor) chain(e *AuditEvent) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Previous = a.last
+	hash, err := auditHash(e)
+	if err != nil {
+		return nil, err
+	}
+	e.Hash = hash
+	record, _ := json.Marshal(e)
+	written := true
+	for _, sink := range a.sinks {
+		if _, ok := sink.(remoteSink); ok {
+			continue
+		}
+		if err := sink.Write(record); err != nil {
+			logrus.Errorf("Unable to write audit record: %v", err)
+			written = false
+		}
+	}
+	if written {
+		a.last = hash
+	}
+	return record, nil
+}
+
+// auditHash hashes the record with its own hash left out
+func auditHash(e *AuditEvent) (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyAuditLog reads JSON lines audit records and returns an error naming
+// the first record that was changed, removed or reordered
+func VerifyAuditLog(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	last := ""
+	for n := 1; scanner.Scan(); n++ {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("Audit record %d is not valid: %v", n, err)
+		}
+		if n > 1 && e.Previous != last {
+			return fmt.Errorf("Audit record %d does not follow the record before it", n)
+		}
+		hash, err := auditHash(&e)
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("Audit record %d was modified", n)
+		}
+		last = e.Hash
+	}
+	return scanner.Err()
+}
+
+// writerSink writes JSON lines to a writer such as stdout
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink writes audit records as JSON lines to w
+func NewWriterSink(w io.Writer) AuditSink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
+
+// fileSink appends JSON lines to a file
+type fileSink struct {
+	writerSink
+	last string
+}
+
+// NewFileSink appends audit records to a file, continuing the chain of the
+// records already in it
+func NewFileSink(path string) (AuditSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{writerSink: writerSink{w: f}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			s.last = e.Hash
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) LastHash() string {
+	return s.last
+}
+
+// webhookSink posts each record to an HTTP endpoint
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink posts audit records as JSON to url
+func NewWebhookSink(url string, timeout time.Duration) AuditSink {
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &webhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *webhookSink) remote() {}
+
+func (s *webhookSink) Write(record []byte) error {
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Audit webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// AuditSettings selects where audit records go. Records go to stdout
+// unless a file or webhook is set.
+type AuditSettings struct {
+	// Stdout keeps writing to stdout next to a file or webhook
+	Stdout bool `yaml:"stdout"`
+	// File is appended to
+	File string `yaml:"file"`
+	// Webhook receives a POST per record
+	Webhook string `yaml:"webhook"`
+	// Timeout bounds a webhook delivery
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// NewAuditor builds the Auditor selected by the audit settings
+func (s *Settings) NewAuditor() (*Auditor, error) {
+	sinks := []AuditSink{}
+	if s.Audit.File != "" {
+		sink, err := NewFileSink(s.Audit.File)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if s.Audit.Webhook != "" {
+		sinks = append(sinks, NewWebhookSink(s.Audit.Webhook, s.Audit.Timeout))
+	}
+	if s.Audit.Stdout || len(sinks) == 0 {
+		sinks = append(sinks, NewWriterSink(os.Stdout))
+	}
+	return NewAuditor(sinks...), nil
+}
@@ -0,0 +1,220 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditChain(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewAuditor(NewWriterSink(&buf))
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/one", Decision: auditAllowed})
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/two", Decision: auditDenied})
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/three", Decision: auditAllowed})
+	assert.NoError(t, VerifyAuditLog(bytes.NewReader(buf.Bytes())))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	var first, second AuditEvent
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	assert.Equal(t, "", first.Previous)
+	assert.Equal(t, first.Hash, second.Previous)
+
+	cases := []struct {
+		name  string
+		lines []string
+		err   string
+	}{
+		{
+			name:  "modified",
+			lines: []string{lines[0], strings.Replace(lines[1], "denied", "allowed", 1), lines[2]},
+			err:   "Audit record 2 was modified",
+		},
+		{
+			name:  "removed",
+			lines: []string{lines[0], lines[2]},
+			err:   "Audit record 2 does not follow",
+		},
+		{
+			name:  "reordered",
+			lines: []string{lines[0], lines[2], lines[1]},
+			err:   "Audit record 2 does not follow",
+		},
+		{
+			name:  "rotated",
+			lines: lines[1:],
+		},
+	}
+	for _, c := range cases {
+		err := VerifyAuditLog(strings.NewReader(strings.Join(c.lines, "\n")))
+		if c.err == "" {
+			assert.NoError(t, err, c.name)
+			continue
+		}
+		if assert.Error(t, err, c.name) {
+			assert.Contains(t, err.Error(), c.err, c.name)
+		}
+	}
+
+	// a nil auditor records nothing
+	var none *Auditor
+	none.Record(&AuditEvent{})
+}
+
+func TestAuditFileSinkResumesChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	settings := &Settings{Audit: AuditSettings{File: path}}
+	a, err := settings.NewAuditor()
+	if !assert.NoError(t, err) {
+		return
+	}
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/one"})
+
+	// a new process continues the chain in the same file
+	a, err = settings.NewAuditor()
+	if !assert.NoError(t, err) {
+		return
+	}
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/two"})
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	assert.NoError(t, VerifyAuditLog(f))
+}
+
+// failingSink refuses every record until it is fixed
+type failingSink struct {
+	fail bool
+}
+
+func (f *failingSink) Write(record []byte) error {
+	if f.fail {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestAuditFailedWriteKeepsChain(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &failingSink{}
+	a := NewAuditor(NewWriterSink(&buf), sink)
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/one"})
+	last := a.last
+
+	sink.fail = true
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/two"})
+	assert.Equal(t, last, a.last)
+
+	// the next record follows the last one every sink holds
+	sink.fail = false
+	e := &AuditEvent{Kind: auditConfig, Repo: "org/three"}
+	a.Record(e)
+	assert.Equal(t, last, e.Previous)
+}
+
+// chanSink hands every record to a channel
+type chanSink chan string
+
+func (c chanSink) Write(record []byte) error {
+	c <- string(record)
+	return nil
+}
+
+func TestAuditSlowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	records := make(chanSink, 2)
+	a := NewAuditor(records, NewWebhookSink(slow.URL, time.Minute))
+	go a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/one"})
+	<-records
+
+	// the first record is stuck on the webhook, the second is still written
+	go a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/two"})
+	select {
+	case record := <-records:
+		assert.Contains(t, record, "org/two")
+	case <-time.After(2 * time.Second):
+		t.Error("a slow webhook held up the next record")
+	}
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	received := make(chan AuditEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var e AuditEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		received <- e
+	}))
+	defer ts.Close()
+
+	a := NewAuditor(NewWebhookSink(ts.URL, 0))
+	a.Record(&AuditEvent{Kind: auditConfig, Repo: "org/name"})
+	e := <-received
+	assert.Equal(t, "org/name", e.Repo)
+	assert.NotEmpty(t, e.Hash)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.Error(t, NewWebhookSink(failing.URL, 0).Write([]byte(`{}`)))
+}
+
+func TestFindAudit(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", prodDenied)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	p := newFindPlugin(ts, WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	_, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	record := strings.TrimSpace(buf.String())
+	var e AuditEvent
+	if !assert.NoError(t, json.Unmarshal([]byte(record), &e)) {
+		return
+	}
+	assert.Equal(t, auditConfig, e.Kind)
+	assert.Equal(t, "org/name", e.Repo)
+	assert.Equal(t, "octocat", e.Sender)
+	assert.Equal(t, "push", e.Event)
+	assert.Equal(t, auditDenied, e.Decision)
+	assert.Equal(t, "7d1c4f3e", e.DecisionID)
+	assert.Equal(t, []string{"qa", "prod"}, e.Environments)
+	assert.Equal(t, []string{"111111111111", "222222222222"}, e.Accounts)
+	assert.Equal(t, []string{"222222222222"}, e.Denied)
+	assert.Equal(t, []string{"DEMO_API_TOKEN_QA", "DEMO_API_TOKEN"}, e.Secrets)
+	assert.Equal(t, []string{"deploy-prod"}, e.Steps)
+	// the minted token never reaches the audit log
+	assert.NotContains(t, record, `"token"`)
+}
@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authPath is the path of the allow rule on the auth api
+const authPath = "/v1/data/demo/drone/allow"
+
+// Authorizer decides whether a repository may deploy to the accounts
+// listed in its .strithon.yml
+type Authorizer interface {
+	Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error)
+}
+
+// remoteAuthorizer asks the auth api over http
+type remoteAuthorizer struct {
+	endpoint string
+	path     string
+	client   *http.Client
+	// upstream labels the call in metrics
+	upstream string
+}
+
+// NewRemoteAuthorizer returns an Authorizer that calls the auth api at
+// endpoint, giving up after timeout when it is not zero
+func NewRemoteAuthorizer(endpoint string, timeout time.Duration) Authorizer {
+	return &remoteAuthorizer{
+		endpoint: endpoint,
+		path:     authPath,
+		client:   &http.Client{Timeout: timeout, Transport: tracingTransport},
+		upstream: upstreamAuth,
+	}
+}
+
+// Authorize posts the policy input to the auth api
+func (r *remoteAuthorizer) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	start := time.Now()
+	res, err := r.authorize(ctx, in, token)
+	observeUpstream(r.upstream, start, err)
+	return res, err
+}
+
+func (r *remoteAuthorizer) authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	payloadContent, _ := json.Marshal(in)
+	payload := strings.NewReader(string(payloadContent))
+	log := logger(ctx)
+	log.Debugf("Payload to the auth api: %s", payloadContent)
+	log.Debugf("Auth endpoint: %s", r.endpoint)
+	request, _ := http.NewRequest("POST", r.endpoint+r.path, payload)
+
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	res, err := r.client.Do(request.WithContext(ctx))
+	if err != nil {
+		log.Errorf("Error calling auth api: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	log.Debugf("Auth api answered with status %d", res.StatusCode)
+	if res.StatusCode >= 500 {
+		log.Errorf("Auth api answered with status %d", res.StatusCode)
+		return nil, fmt.Errorf("%w: status %d", ErrAuthUnavailable, res.StatusCode)
+	}
+
+	var authRes AuthResponse
+	err = json.Unmarshal(body, &authRes)
+	if err != nil {
+		log.Errorf("Error unmarshalling %s: %s\n\n", string(body), err)
+		return nil, fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+	}
+	return &authRes, nil
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteAuthorizer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer ok":
+			w.Write([]byte(`{"result":true,"decision_id":"506a05fc"}`))
+		case "Bearer html":
+			w.Write([]byte(`<html>bad gateway</html>`))
+		case "Bearer down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "Bearer slow":
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte(`{"result":true}`))
+		}
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		token       string
+		unavailable bool
+	}{
+		{token: "ok"},
+		{token: "html", unavailable: true},
+		{token: "down", unavailable: true},
+		{token: "slow", unavailable: true},
+	}
+	a := NewRemoteAuthorizer(ts.URL, 50*time.Millisecond)
+	for _, c := range cases {
+		res, err := a.Authorize(noContext, &AuthRequest{}, c.token)
+		assert.Equal(t, c.unavailable, errors.Is(err, ErrAuthUnavailable), c.token)
+		if !c.unavailable && assert.NotNil(t, res, c.token) {
+			assert.Equal(t, "506a05fc", res.DecisionID)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+// CredentialHook sets the variables a deploy step needs to reach the cloud
+// account of its environment
+type CredentialHook func(step *yaml.Container, env Environment)
+
+// defaultCredentialHooks point the deploy steps of each cloud at the
+// environment's account, they hand out no secrets
+var defaultCredentialHooks = map[string]CredentialHook{
+	cloudAWS:   awsCredentials,
+	cloudGCP:   gcpCredentials,
+	cloudAzure: azureCredentials,
+}
+
+// WithCredentialHook replaces the credential hook of a cloud
+func WithCredentialHook(cloud string, hook CredentialHook) Option {
+	return func(p *Plugin) {
+		if p.credentials == nil {
+			p.credentials = map[string]CredentialHook{}
+		}
+		p.credentials[cloud] = hook
+	}
+}
+
+// credentialHook returns the hook for a cloud, nil when there is none
+func (p *Plugin) credentialHook(cloud string) CredentialHook {
+	if hook, ok := p.credentials[cloud]; ok {
+		return hook
+	}
+	return defaultCredentialHooks[cloud]
+}
+
+func awsCredentials(step *yaml.Container, env Environment) {
+	setVariable(step, "AWS_ACCOUNT_ID", string(env.Account))
+	setVariable(step, "AWS_DEFAULT_REGION", env.Region)
+}
+
+func gcpCredentials(step *yaml.Container, env Environment) {
+	setVariable(step, "GOOGLE_CLOUD_PROJECT", env.Project)
+	setVariable(step, "CLOUDSDK_CORE_PROJECT", env.Project)
+	setVariable(step, "CLOUDSDK_COMPUTE_REGION", env.Region)
+}
+
+func azureCredentials(step *yaml.Container, env Environment) {
+	setVariable(step, "ARM_SUBSCRIPTION_ID", env.Subscription)
+	setVariable(step, "ARM_TENANT_ID", env.Tenant)
+	setVariable(step, "AZURE_SUBSCRIPTION_ID", env.Subscription)
+	setVariable(step, "AZURE_TENANT_ID", env.Tenant)
+	setVariable(step, "AZURE_DEFAULTS_LOCATION", env.Region)
+}
+
+// setVariable sets a step variable unless the step already sets it or the
+// value is empty
+func setVariable(step *yaml.Container, name, value string) {
+	if value == "" {
+		return
+	}
+	if _, ok := step.Environment[name]; ok {
+		return
+	}
+	if step.Environment == nil {
+		step.Environment = map[string]*yaml.Variable{}
+	}
+	step.Environment[name] = &yaml.Variable{Value: value}
+}
+
+// injectCredentials runs the credential hook of the environment's cloud on
+// every deploy step tied to an environment
+func (p *Plugin) injectCredentials(pipe *yaml.Pipeline, envs []Environment, build *drone.Build, generated generatedSteps) {
+	byName := map[string]Environment{}
+	names := []string{}
+	for _, env := range envs {
+		byName[env.Name] = env
+		names = append(names, env.Name)
+	}
+	for _, step := range pipe.Steps {
+		deploy, target := generated.deployStep(pipe, step, build, names, p.settings.Matchers)
+		env, ok := byName[target]
+		if !deploy || !ok {
+			continue
+		}
+		if hook := p.credentialHook(env.Cloud); hook != nil {
+			hook(step, env)
+		}
+	}
+}
+
+// addCredentials points the deploy steps of every pipeline at the cloud
+// account of their environment
+func (p *Plugin) addCredentials(ctx context.Context, content string, f *StrithonFile, build *drone.Build, generated generatedSteps) (string, error) {
+	envs := serviceEnvironments(f)
+	if len(envs) == 0 {
+		return content, nil
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", err
+	}
+	for _, r := range manifest.Resources {
+		if v, ok := r.(*yaml.Pipeline); ok {
+			p.injectCredentials(v, envs, build, generated)
+		}
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, nil
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingAuthorizer allows everything and keeps the last policy input
+type recordingAuthorizer struct {
+	in *AuthRequest
+}
+
+func (r *recordingAuthorizer) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	r.in = in
+	return &AuthResponse{Result: AuthResult{Allow: true}}, nil
+}
+
+func TestInjectCredentials(t *testing.T) {
+	envs := []Environment{
+		{Name: "qa", Cloud: cloudAWS, Account: "111111111111", Region: "us-east-1"},
+		{Name: "analytics", Cloud: cloudGCP, Project: "strithon-prod-1", Region: "us-central1"},
+		{Name: "prod", Cloud: cloudAzure, Subscription: "8f0e", Tenant: "0a1b"},
+	}
+	step := func(env string) *yaml.Container {
+		return &yaml.Container{
+			Name:        "deploy-" + env,
+			Image:       "plugins/deploy",
+			Environment: map[string]*yaml.Variable{"ENVIRON": {Value: env}},
+		}
+	}
+	pipe := &yaml.Pipeline{Steps: []*yaml.Container{
+		step("qa"), step("analytics"), step("prod"), step("unknown"),
+		{Name: "test", Image: "golang", Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "qa"}}},
+	}}
+	pipe.Steps[0].Environment["AWS_DEFAULT_REGION"] = &yaml.Variable{Value: "eu-west-1"}
+
+	p := New("", "", "", "", "", "", "", "", nil, nil)
+	p.injectCredentials(pipe, envs, nil, nil)
+
+	qa := pipe.Steps[0].Environment
+	assert.Equal(t, "111111111111", qa["AWS_ACCOUNT_ID"].Value)
+	// variables set by the step win
+	assert.Equal(t, "eu-west-1", qa["AWS_DEFAULT_REGION"].Value)
+
+	gcp := pipe.Steps[1].Environment
+	assert.Equal(t, "strithon-prod-1", gcp["GOOGLE_CLOUD_PROJECT"].Value)
+	assert.Equal(t, "us-central1", gcp["CLOUDSDK_COMPUTE_REGION"].Value)
+
+	azure := pipe.Steps[2].Environment
+	assert.Equal(t, "8f0e", azure["ARM_SUBSCRIPTION_ID"].Value)
+	assert.Equal(t, "0a1b", azure["AZURE_TENANT_ID"].Value)
+	assert.NotContains(t, azure, "AZURE_DEFAULTS_LOCATION")
+
+	// steps of unknown environments and other steps are left alone
+	assert.Len(t, pipe.Steps[3].Environment, 1)
+	assert.Len(t, pipe.Steps[4].Environment, 1)
+}
+
+func TestWithCredentialHook(t *testing.T) {
+	called := []string{}
+	p := New("", "", "", "", "", "", "", "", nil, nil, WithCredentialHook(cloudAzure, func(step *yaml.Container, env Environment) {
+		called = append(called, step.Name)
+		setVariable(step, "AZURE_CLIENT_ID", "from-"+strings.ToLower(env.Name))
+	}))
+	pipe := &yaml.Pipeline{Steps: []*yaml.Container{{
+		Name:        "deploy",
+		Image:       "plugins/deploy",
+		Environment: map[string]*yaml.Variable{markerVariable: {Value: "prod"}},
+	}}}
+	p.injectCredentials(pipe, []Environment{{Name: "prod", Cloud: cloudAzure, Subscription: "8f0e"}}, nil, nil)
+	assert.Equal(t, []string{"deploy"}, called)
+	assert.Equal(t, "from-prod", pipe.Steps[0].Environment["AZURE_CLIENT_ID"].Value)
+	assert.NotContains(t, pipe.Steps[0].Environment, "ARM_SUBSCRIPTION_ID")
+}
+
+func TestValidateClouds(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone.yml", "testdata/.strithon-clouds.yml", "")
+	defer ts.Close()
+
+	a := &recordingAuthorizer{}
+	p := newFindPlugin(ts, WithAuthorizer(a))
+	d, err := p.Validate(noContext, findRequest(), "")
+	got := a.in
+	if !assert.NoError(t, err) || !assert.NotNil(t, got) {
+		return
+	}
+	assert.True(t, d.Allowed)
+	assert.Equal(t, []string{"111111111111", "strithon-prod-1", "8f0e1a2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b"}, got.Input.Accounts)
+	assert.Equal(t, AuthEnvironment{
+		Name:    "prod",
+		Account: "8f0e1a2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b",
+		Cloud:   cloudAzure,
+		Tenant:  "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d",
+		Region:  "eastus",
+	}, got.Input.Environments[2])
+}
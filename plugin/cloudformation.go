@@ -0,0 +1,284 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// defaultCloudFormationImage deploys the stacks when no image is set
+	defaultCloudFormationImage = "plugins/aws-cloudformation"
+)
+
+// stackNameSettings are the settings a step may name its stack with
+var stackNameSettings = []string{"stackname", "stack_name", "name"}
+
+// CloudFormationSettings configures the deploy steps generated for the
+// aws-cloudformation documents of .strithon.yml
+type CloudFormationSettings struct {
+	// Image overrides the plugin image of the generated steps
+	Image string `yaml:"image"`
+	// Disabled stops steps from being generated
+	Disabled bool `yaml:"disabled"`
+}
+
+func (s *CloudFormationSettings) image() string {
+	if s.Image == "" {
+		return defaultCloudFormationImage
+	}
+	return s.Image
+}
+
+// cloudFormationStepName is the name of the step deploying a stack to env
+func cloudFormationStepName(stack *CloudFormation, env string) string {
+	return fmt.Sprintf("cloudformation-%s-%s", stack.Spec.Name, env)
+}
+
+// cloudFormationStep builds the step deploying a stack to an environment.
+// The step runs when the build is promoted to the environment and only gets
+// the token of that environment, if one was injected.
+func (s *CloudFormationSettings) cloudFormationStep(stack *CloudFormation, env Environment, secrets []string) *yaml.Container {
+	mode := "createOrUpdate"
+	if stack.Spec.State == stateDelete {
+		mode = "delete"
+	}
+	step := &yaml.Container{
+		Name:  cloudFormationStepName(stack, env.Name),
+		Image: s.image(),
+		Settings: map[string]*yaml.Parameter{
+			"mode":      {Value: mode},
+			"stackname": {Value: stack.Spec.Name},
+			"template":  {Value: stack.Spec.Template},
+			"region":    {Value: env.Region},
+		},
+		Environment: map[string]*yaml.Variable{
+			markerVariable:       {Value: env.Name},
+			"AWS_ACCOUNT_ID":     {Value: string(env.Account)},
+			"AWS_DEFAULT_REGION": {Value: env.Region},
+		},
+		When: yaml.Conditions{
+			Event:  yaml.Condition{Include: []string{"promote"}},
+			Target: yaml.Condition{Include: []string{env.Name}},
+		},
+	}
+	if len(stack.Spec.AdditionalArtifacts) > 0 {
+		step.Settings["additional_artifacts"] = &yaml.Parameter{Value: stack.Spec.AdditionalArtifacts}
+	}
+	if secret := tokenSecretName(env.Name); contains(secrets, secret) {
+		step.Environment[secret] = &yaml.Variable{Secret: secret}
+	}
+	return step
+}
+
+// generatedStep is a deploy step the extension added to a pipeline
+type generatedStep struct {
+	Pipeline    string
+	Step        string
+	Environment string
+}
+
+// generatedSteps are the steps added for a config request. They are kept
+// apart from the pipeline so a repo cannot pass its own steps off as
+// generated ones.
+type generatedSteps []generatedStep
+
+// environment returns the environment a generated step deploys to, false
+// when the extension did not add the step
+func (g generatedSteps) environment(pipe *yaml.Pipeline, step *yaml.Container) (string, bool) {
+	for _, s := range g {
+		if s.Pipeline == pipe.Name && s.Step == step.Name {
+			return s.Environment, true
+		}
+	}
+	return "", false
+}
+
+// names returns the names of the generated steps
+func (g generatedSteps) names() []string {
+	names := []string{}
+	for _, s := range g {
+		names = append(names, s.Step)
+	}
+	return names
+}
+
+// deployStep is deployStep, with generated steps deploying to the
+// environment they were added for whatever the matchers say
+func (g generatedSteps) deployStep(pipe *yaml.Pipeline, step *yaml.Container, build *drone.Build, envs []string, matchers []StepMatcher) (bool, string) {
+	if env, ok := g.environment(pipe, step); ok {
+		return true, env
+	}
+	return deployStep(step, build, envs, matchers)
+}
+
+// hasStep reports whether the pipeline already has a step with the name
+func hasStep(pipe *yaml.Pipeline, name string) bool {
+	for _, step := range pipe.Steps {
+		if step.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueStepName returns name, or name with the first free numeric suffix
+// when the pipeline already has a step with it
+func uniqueStepName(pipe *yaml.Pipeline, name string) string {
+	unique := name
+	for i := 2; hasStep(pipe, unique); i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+// stackName returns the stack a step names in its settings
+func stackName(step *yaml.Container) string {
+	for _, key := range stackNameSettings {
+		if p, ok := step.Settings[key]; ok && p != nil && p.Value != nil {
+			return fmt.Sprint(p.Value)
+		}
+	}
+	return ""
+}
+
+// hasEquivalentStep reports whether a pipeline already deploys the stack to
+// env with the same plugin. A step whose environment cannot be worked out
+// counts for every environment.
+func (s *CloudFormationSettings) hasEquivalentStep(manifest *yaml.Manifest, stack *CloudFormation, env string, build *drone.Build, envs []string) bool {
+	for _, r := range manifest.Resources {
+		pipe, ok := r.(*yaml.Pipeline)
+		if !ok {
+			continue
+		}
+		for _, step := range pipe.Steps {
+			if imageName(step.Image) != imageName(s.image()) {
+				continue
+			}
+			if name := stackName(step); name != "" && name != stack.Spec.Name {
+				continue
+			}
+			if target := stepEnvironment(step, build, envs); target == "" || target == env {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendSteps adds the generated steps to the end of the pipeline. When the
+// pipeline is a graph each step waits for the steps before it.
+func appendSteps(pipe *yaml.Pipeline, steps []*yaml.Container) {
+	graph := false
+	for _, step := range pipe.Steps {
+		if len(step.DependsOn) > 0 {
+			graph = true
+		}
+	}
+	previous := []string{}
+	for _, step := range pipe.Steps {
+		previous = append(previous, step.Name)
+	}
+	for _, step := range steps {
+		if graph {
+			step.DependsOn = append([]string{}, previous...)
+			previous = []string{step.Name}
+		}
+		pipe.Steps = append(pipe.Steps, step)
+	}
+}
+
+// serviceEnvironments returns the environments of the service document
+// with their names lowercased
+func serviceEnvironments(f *StrithonFile) []Environment {
+	envs := []Environment{}
+	for _, env := range f.Service().Metadata.Environments {
+		env.Name = strings.ToLower(env.Name)
+		envs = append(envs, env)
+	}
+	return envs
+}
+
+// addCloudFormationSteps appends a deploy step to the first pipeline for
+// every stack and AWS environment that no step deploys yet, and returns
+// the steps it added
+func (p *Plugin) addCloudFormationSteps(ctx context.Context, content string, f *StrithonFile, build *drone.Build, secrets []string) (string, generatedSteps, error) {
+	settings := &p.settings.CloudFormation
+	stacks := f.CloudFormation()
+	if settings.Disabled || len(stacks) == 0 {
+		return content, nil, nil
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
+	}
+	var pipe *yaml.Pipeline
+	for _, r := range manifest.Resources {
+		if v, ok := r.(*yaml.Pipeline); ok {
+			pipe = v
+			break
+		}
+	}
+	if pipe == nil {
+		return content, nil, nil
+	}
+
+	envs := serviceEnvironments(f)
+	names := []string{}
+	for _, env := range envs {
+		names = append(names, env.Name)
+	}
+	steps := []*yaml.Container{}
+	for _, stack := range stacks {
+		for _, env := range envs {
+			// stacks only deploy to AWS
+			if env.Cloud != cloudAWS {
+				continue
+			}
+			if settings.hasEquivalentStep(manifest, stack, env.Name, build, names) {
+				continue
+			}
+			// an environment spread over several accounts gets a step per
+			// account
+			accounts, err := p.settings.Organizations.environmentAccounts(env)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, acct := range accounts {
+				target := env
+				target.Account = AccountNumber(acct.Account)
+				step := settings.cloudFormationStep(stack, target, secrets)
+				if len(accounts) > 1 {
+					step.Name = fmt.Sprintf("%s-%s", step.Name, acct.Account)
+				}
+				// a step of the repo already has the name
+				if hasStep(pipe, step.Name) {
+					logger(ctx).Warnf("CloudFormation step %s not added, pipeline %s has a step with that name", step.Name, pipe.Name)
+					continue
+				}
+				steps = append(steps, step)
+			}
+		}
+	}
+	if len(steps) == 0 {
+		return content, nil, nil
+	}
+	appendSteps(pipe, steps)
+
+	added := generatedSteps{}
+	for _, step := range steps {
+		added = append(added, generatedStep{
+			Pipeline:    pipe.Name,
+			Step:        step.Name,
+			Environment: variableEnvironment(step, markerVariable),
+		})
+	}
+	logger(ctx).Infof("Added CloudFormation steps to pipeline %s: %s", pipe.Name, strings.Join(added.names(), ", "))
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, added, nil
+}
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudFormationStep(t *testing.T) {
+	stack := &CloudFormation{Kind: kindCloudFormation, Spec: CloudFormationSpec{
+		Name:                "stack",
+		Template:            "templates/resource.yml",
+		AdditionalArtifacts: []string{"deployment.zip"},
+		State:               stateDelete,
+	}}
+	env := Environment{Name: "qa", Cloud: cloudAWS, Account: "111111111111", Region: "us-east-1"}
+	s := &CloudFormationSettings{}
+	step := s.cloudFormationStep(stack, env, []string{"DEMO_API_TOKEN_QA", "DEMO_API_TOKEN"})
+
+	assert.Equal(t, "cloudformation-stack-qa", step.Name)
+	assert.Equal(t, defaultCloudFormationImage, step.Image)
+	assert.Equal(t, "delete", step.Settings["mode"].Value)
+	assert.Equal(t, "stack", step.Settings["stackname"].Value)
+	assert.Equal(t, []string{"deployment.zip"}, step.Settings["additional_artifacts"].Value)
+	assert.Equal(t, "111111111111", step.Environment["AWS_ACCOUNT_ID"].Value)
+	assert.Equal(t, "DEMO_API_TOKEN_QA", step.Environment["DEMO_API_TOKEN_QA"].Secret)
+	assert.NotContains(t, step.Environment, "DEMO_API_TOKEN")
+	assert.Equal(t, []string{"qa"}, step.When.Target.Include)
+
+	// generated steps are deploy steps whatever the matchers say
+	matchers := []StepMatcher{{Name: "cli", Images: []string{"amazon/aws-cli*"}}}
+	pipe := &yaml.Pipeline{Name: "default", Steps: []*yaml.Container{step}}
+	generated := generatedSteps{{Pipeline: "default", Step: step.Name, Environment: "qa"}}
+	deploy, target := generated.deployStep(pipe, step, nil, nil, matchers)
+	assert.True(t, deploy)
+	assert.Equal(t, "qa", target)
+
+	// the same step in another pipeline was not generated
+	deploy, _ = generated.deployStep(&yaml.Pipeline{Name: "other"}, step, nil, nil, matchers)
+	assert.False(t, deploy)
+
+	// no token is handed out for environments that were not injected
+	step = s.cloudFormationStep(stack, Environment{Name: "prod", Cloud: cloudAWS}, []string{"DEMO_API_TOKEN_QA"})
+	assert.NotContains(t, step.Environment, "DEMO_API_TOKEN_PROD")
+}
+
+func TestDeployStepIgnoresGeneratedVariable(t *testing.T) {
+	// a repo step claiming to be generated keeps the environment its
+	// matcher pins
+	step := &yaml.Container{
+		Name:  "deploy",
+		Image: "plugins/ecs",
+		Environment: map[string]*yaml.Variable{
+			"STRITHON_GENERATED": {Value: kindCloudFormation},
+			markerVariable:       {Value: "qa"},
+		},
+	}
+	matchers := []StepMatcher{{Name: "ecs", Images: []string{"plugins/ecs"}, Environment: "prod"}}
+	deploy, target := generatedSteps(nil).deployStep(&yaml.Pipeline{}, step, nil, []string{"qa", "prod"}, matchers)
+	assert.True(t, deploy)
+	assert.Equal(t, "prod", target)
+}
+
+func TestHasEquivalentStep(t *testing.T) {
+	stack := &CloudFormation{Spec: CloudFormationSpec{Name: "stack"}}
+	envs := []string{"qa", "pr"}
+	s := &CloudFormationSettings{}
+	b, _ := ioutil.ReadFile("testdata/.drone.yml")
+	manifest, _ := yaml.Parse(bytes.NewReader(b))
+
+	// deploy-qa and deploy-pr use the plugin without naming a stack
+	assert.True(t, s.hasEquivalentStep(manifest, stack, "qa", &drone.Build{}, envs))
+	assert.True(t, s.hasEquivalentStep(manifest, stack, "pr", &drone.Build{}, envs))
+	assert.False(t, s.hasEquivalentStep(manifest, stack, "prod", &drone.Build{}, envs))
+
+	// another stack is not equivalent
+	pipe := manifest.Resources[0].(*yaml.Pipeline)
+	pipe.Steps[2].Settings = map[string]*yaml.Parameter{"stack_name": {Value: "other"}}
+	assert.False(t, s.hasEquivalentStep(manifest, stack, "qa", &drone.Build{}, envs))
+
+	// nor is another image
+	s.Image = "example/cloudformation"
+	assert.False(t, s.hasEquivalentStep(manifest, stack, "pr", &drone.Build{}, envs))
+}
+
+func TestUniqueStepName(t *testing.T) {
+	pipe := &yaml.Pipeline{Steps: []*yaml.Container{{Name: "guardrails"}, {Name: "guardrails-2"}}}
+	assert.Equal(t, "policy-advisory", uniqueStepName(pipe, "policy-advisory"))
+	assert.Equal(t, "guardrails-3", uniqueStepName(pipe, "guardrails"))
+}
+
+func TestAppendSteps(t *testing.T) {
+	pipe := &yaml.Pipeline{Steps: []*yaml.Container{{Name: "test"}, {Name: "zip"}}}
+	appendSteps(pipe, []*yaml.Container{{Name: "qa"}, {Name: "prod"}})
+	assert.Len(t, pipe.Steps, 4)
+	assert.Empty(t, pipe.Steps[2].DependsOn)
+
+	// in a graph the steps wait for the pipeline and then for each other
+	pipe = &yaml.Pipeline{Steps: []*yaml.Container{{Name: "test"}, {Name: "zip", DependsOn: []string{"test"}}}}
+	appendSteps(pipe, []*yaml.Container{{Name: "qa"}, {Name: "prod"}})
+	assert.Equal(t, []string{"test", "zip"}, pipe.Steps[2].DependsOn)
+	assert.Equal(t, []string{"qa"}, pipe.Steps[3].DependsOn)
+}
+
+func TestFindCloudFormation(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-build.yml", "testdata/.strithon-cloudformation.yml", prodDenied)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	p := newFindPlugin(ts, WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := yaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	steps := map[string]*yaml.Container{}
+	for _, step := range manifest.Resources[0].(*yaml.Pipeline).Steps {
+		steps[step.Name] = step
+	}
+	qa := steps["cloudformation-config-check-extension-qa"]
+	if assert.NotNil(t, qa) {
+		assert.Equal(t, "us-east-1", qa.Settings["region"].Value)
+		assert.Equal(t, []string{"test", "package"}, qa.DependsOn)
+		assert.Equal(t, "DEMO_API_TOKEN_QA", qa.Environment["DEMO_API_TOKEN_QA"].Secret)
+	}
+
+	// the prod account is denied, so its generated step is replaced too
+	assert.NotContains(t, steps, "cloudformation-config-check-extension-prod")
+	prod := steps["cloudformation-config-check-extension-prod-unauthorized"]
+	if assert.NotNil(t, prod) {
+		assert.Equal(t, defaultDenialImage, prod.Image)
+	}
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, []string{
+			"cloudformation-config-check-extension-qa",
+			"cloudformation-config-check-extension-prod",
+		}, e.Generated)
+		assert.Equal(t, []string{"cloudformation-config-check-extension-prod"}, e.Steps)
+	}
+}
@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Denial describes a single account that the policy refused for an environment
+type Denial struct {
+	Account     string `json:"account"`
+	Environment string `json:"environment,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	// OU is the path of OUs the account was found through
+	OU string `json:"ou,omitempty"`
+}
+
+// AuthResult is a special struct that acts as a conditional bool/object type.
+// Older policies answer with a plain boolean, newer ones with a verdict and
+// the reason each account was denied.
+type AuthResult struct {
+	Allow   bool     `json:"allow"`
+	Denials []Denial `json:"denials,omitempty"`
+}
+
+// UnmarshalJSON handles the unmarshalling of the AuthResult type
+func (r *AuthResult) UnmarshalJSON(b []byte) error {
+	var allow bool
+	if err := json.Unmarshal(b, &allow); err == nil {
+		*r = AuthResult{Allow: allow}
+		return nil
+	}
+	// alias the type so the object form does not recurse into this method
+	type authResult AuthResult
+	var res authResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return err
+	}
+	*r = AuthResult(res)
+	return nil
+}
+
+// Decision is the outcome of a policy check for a repository
+type Decision struct {
+	ID           string
+	Allowed      bool
+	Denials      []Denial
+	Environments []string
+	// Requested lists the accounts the policy was asked about
+	Requested []string
+	// Outage is set when the policy could not be asked
+	Outage bool
+	// FailOpen lists the environments allowed because of an outage
+	FailOpen []string
+	// Restricted lists the environments the deploy rules withhold
+	Restricted []string
+}
+
+// NewDecision builds a decision from an auth api response. When the policy
+// denies without saying which accounts, every environment in the request is
+// considered denied.
+func NewDecision(in *AuthRequest, res *AuthResponse) *Decision {
+	decision := &Decision{
+		ID:        res.DecisionID,
+		Allowed:   res.Result.Allow && len(res.Result.Denials) == 0,
+		Requested: in.Input.Accounts,
+	}
+	decision.Environments = in.Input.environmentNames()
+	if decision.Allowed {
+		return decision
+	}
+	if len(res.Result.Denials) > 0 {
+		// a denial without an environment applies to every environment
+		// that deploys to the account
+		for _, denial := range res.Result.Denials {
+			expanded := false
+			for _, env := range in.Input.Environments {
+				if denial.Environment == "" && env.Account == denial.Account {
+					expanded = true
+					decision.Denials = append(decision.Denials, Denial{
+						Account:     denial.Account,
+						Environment: env.Name,
+						Reason:      denial.Reason,
+						OU:          env.OU,
+					})
+				}
+			}
+			if !expanded {
+				if denial.OU == "" {
+					denial.OU = accountOU(in, denial)
+				}
+				decision.Denials = append(decision.Denials, denial)
+			}
+		}
+		return decision
+	}
+	for _, env := range in.Input.Environments {
+		decision.Denials = append(decision.Denials, Denial{
+			Account:     env.Account,
+			Environment: env.Name,
+			OU:          env.OU,
+		})
+	}
+	// environments are optional in the input, fall back to the bare accounts
+	if len(decision.Denials) == 0 {
+		for _, acct := range in.Input.Accounts {
+			decision.Denials = append(decision.Denials, Denial{Account: acct})
+		}
+	}
+	return decision
+}
+
+// environmentNames returns the names of the environments in the input,
+// once each even when an environment deploys to several accounts
+func (in *AuthInput) environmentNames() []string {
+	var names []string
+	for _, env := range in.Environments {
+		if !contains(names, env.Name) {
+			names = append(names, env.Name)
+		}
+	}
+	return names
+}
+
+// accountOU returns the OU path of the environment the denial refers to
+func accountOU(in *AuthRequest, denial Denial) string {
+	for _, env := range in.Input.Environments {
+		if env.Account == denial.Account && strings.EqualFold(env.Name, denial.Environment) {
+			return env.OU
+		}
+	}
+	return ""
+}
+
+// Accounts returns the sorted, de-duplicated list of denied accounts
+func (d *Decision) Accounts() []string {
+	if d == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	accts := []string{}
+	for _, denial := range d.Denials {
+		if seen[denial.Account] {
+			continue
+		}
+		seen[denial.Account] = true
+		accts = append(accts, denial.Account)
+	}
+	sort.Strings(accts)
+	return accts
+}
+
+// DeniedEnvironments returns the set of denied environments. The second value
+// is false when a denial could not be tied to an environment, in which case
+// every environment has to be treated as denied.
+func (d *Decision) DeniedEnvironments() (map[string]bool, bool) {
+	envs := make(map[string]bool)
+	if d == nil {
+		return envs, true
+	}
+	for _, denial := range d.Denials {
+		if denial.Environment == "" {
+			return envs, false
+		}
+		envs[strings.ToLower(denial.Environment)] = true
+	}
+	return envs, true
+}
+
+// Reasons returns a human readable line for each denial
+func (d *Decision) Reasons() []string {
+	if d == nil {
+		return nil
+	}
+	lines := []string{}
+	for _, denial := range d.Denials {
+		line := fmt.Sprintf("account %s", denial.Account)
+		if denial.Environment != "" {
+			line = fmt.Sprintf("%s (environment %s)", line, denial.Environment)
+		}
+		if denial.OU != "" {
+			line = fmt.Sprintf("%s from OU %s", line, denial.OU)
+		}
+		if denial.Reason != "" {
+			line = fmt.Sprintf("%s: %s", line, denial.Reason)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// String summarises the decision for logging
+func (d *Decision) String() string {
+	if d == nil {
+		return "no decision"
+	}
+	if d.Allowed {
+		return fmt.Sprintf("allowed (decision %s)", d.ID)
+	}
+	return fmt.Sprintf("denied %s (decision %s)", strings.Join(d.Reasons(), "; "), d.ID)
+}
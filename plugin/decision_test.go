@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthResultUnmarshal(t *testing.T) {
+	cases := []struct {
+		body    string
+		allow   bool
+		denials int
+		err     bool
+	}{
+		{
+			body:  `{"result":true,"decision_id":"one"}`,
+			allow: true,
+		},
+		{
+			body:  `{"result":false,"decision_id":"two"}`,
+			allow: false,
+		},
+		{
+			body:    `{"result":{"allow":false,"denials":[{"account":"222222222222","environment":"prod","reason":"nope"}]},"decision_id":"three"}`,
+			allow:   false,
+			denials: 1,
+		},
+		{
+			body: `{"result":"yes","decision_id":"four"}`,
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		var res AuthResponse
+		err := json.Unmarshal([]byte(c.body), &res)
+		if (err == nil) == c.err {
+			t.Errorf("%s: expected error to be %v, got %v", c.body, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		assert.Equal(t, c.allow, res.Result.Allow, c.body)
+		assert.Len(t, res.Result.Denials, c.denials, c.body)
+	}
+}
+
+func TestNewDecision(t *testing.T) {
+	var in AuthRequest
+	in.Input.Accounts = []string{"111111111111", "222222222222"}
+	in.Input.Environments = []AuthEnvironment{
+		{Name: "qa", Account: "111111111111"},
+		{Name: "prod", Account: "222222222222"},
+	}
+
+	allowed := NewDecision(&in, &AuthResponse{Result: AuthResult{Allow: true}, DecisionID: "a"})
+	assert.True(t, allowed.Allowed)
+	assert.Empty(t, allowed.Accounts())
+
+	all := NewDecision(&in, &AuthResponse{Result: AuthResult{Allow: false}, DecisionID: "b"})
+	assert.False(t, all.Allowed)
+	assert.Equal(t, []string{"111111111111", "222222222222"}, all.Accounts())
+	assert.Equal(t, "b", all.ID)
+
+	some := NewDecision(&in, &AuthResponse{
+		Result: AuthResult{
+			Denials: []Denial{{Account: "222222222222", Environment: "prod", Reason: "not allowed"}},
+		},
+		DecisionID: "c",
+	})
+	assert.False(t, some.Allowed)
+	assert.Equal(t, []string{"222222222222"}, some.Accounts())
+	assert.Equal(t, []string{"account 222222222222 (environment prod): not allowed"}, some.Reasons())
+}
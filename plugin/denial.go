@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// defaultDenialImage runs the denial step
+	defaultDenialImage = "alpine"
+
+	// defaultDenialLink is where developers request access
+	defaultDenialLink = "https://github.com/bellyjay1005/aws-drone-policy"
+
+	// bannerDelimiter ends the heredoc printing the banner
+	bannerDelimiter = "STRITHON_DENIED"
+
+	// invalidStepName is the step reporting an invalid .strithon.yml
+	invalidStepName = "strithon-yml-invalid"
+)
+
+// defaultDenialTemplate is the banner printed by a denial step
+const defaultDenialTemplate = `================================================================
+ DEPLOY BLOCKED: {{ .Step }}
+================================================================
+{{ .Repo }} is unauthorized to deploy to accounts {{ join .Accounts ", " }}.
+{{ range .Denials }}
+  - account {{ .Account }}{{ if .Environment }} (environment {{ .Environment }}){{ end }}{{ if .OU }} from OU {{ .OU }}{{ end }}{{ if .Reason }}: {{ .Reason }}{{ end }}
+{{- end }}
+{{ if .DecisionID }}
+Decision ID: {{ .DecisionID }}
+Include it when asking the platform team for help.
+{{ end }}
+Update permissions in {{ .Link }}.
+================================================================`
+
+// DenialSettings configures the step that replaces a denied deploy step
+type DenialSettings struct {
+	// Image runs the denial step, alpine unless set
+	Image string `yaml:"image"`
+	// Link is where developers request access
+	Link string `yaml:"link"`
+	// Template is a text/template for the banner
+	Template string `yaml:"template"`
+}
+
+// denialData is passed to the banner template
+type denialData struct {
+	Step         string
+	Repo         string
+	Accounts     []string
+	Environments []string
+	Denials      []Denial
+	DecisionID   string
+	Link         string
+}
+
+// Validate checks the banner template parses
+func (d *DenialSettings) Validate() error {
+	_, err := d.template()
+	return err
+}
+
+func (d *DenialSettings) template() (*template.Template, error) {
+	text := d.Template
+	if text == "" {
+		text = defaultDenialTemplate
+	}
+	return template.New("denial").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+// denialStep rewrites a step so it prints the denial banner and fails,
+// dropping anything that would hand it credentials
+func (d *DenialSettings) denialStep(step *yaml.Container, repo string, decision *Decision) error {
+	tmpl, err := d.template()
+	if err != nil {
+		return err
+	}
+	link := d.Link
+	if link == "" {
+		link = defaultDenialLink
+	}
+	envs, _ := decision.DeniedEnvironments()
+	data := denialData{
+		Step:       step.Name,
+		Repo:       repo,
+		Accounts:   decision.Accounts(),
+		Denials:    decision.Denials,
+		DecisionID: decision.ID,
+		Link:       link,
+	}
+	for env := range envs {
+		data.Environments = append(data.Environments, env)
+	}
+	sort.Strings(data.Environments)
+	var banner bytes.Buffer
+	if err := tmpl.Execute(&banner, data); err != nil {
+		return err
+	}
+	d.blockStep(step, banner.String())
+	return nil
+}
+
+// blockStep rewrites a step so it prints the banner and fails, dropping
+// anything that would hand it credentials
+func (d *DenialSettings) blockStep(step *yaml.Container, banner string) {
+	step.Image = d.Image
+	if step.Image == "" {
+		step.Image = defaultDenialImage
+	}
+	step.Settings = nil
+	step.Entrypoint = nil
+	step.Command = nil
+	step.Privileged = false
+	step.Failure = ""
+	for name, v := range step.Environment {
+		if v != nil && v.Secret != "" {
+			delete(step.Environment, name)
+		}
+	}
+	step.Commands = []string{
+		fmt.Sprintf("cat <<'%s'\n%s\n%s", bannerDelimiter, banner, bannerDelimiter),
+		"exit 1",
+	}
+}
+
+// invalidPipeline replaces the steps and services of a pipeline with a
+// single step listing the problems in .strithon.yml and failing
+func (d *DenialSettings) invalidPipeline(pipe *yaml.Pipeline, errs ValidationErrors) {
+	banner := invalidBanner(" INVALID .strithon.yml", errs, "Nothing was deployed. Fix .strithon.yml and push again.")
+	pipe.Services = nil
+	pipe.Steps = []*yaml.Container{{
+		Name:  invalidStepName,
+		Image: d.image(),
+		Commands: []string{
+			fmt.Sprintf("cat <<'%s'\n%s\n%s", bannerDelimiter, banner, bannerDelimiter),
+			"exit 1",
+		},
+	}}
+}
+
+// invalidAdvisory adds a non-blocking step listing the problems in
+// .strithon.yml in front of the pipeline, which runs unchanged
+func (d *DenialSettings) invalidAdvisory(pipe *yaml.Pipeline, errs ValidationErrors) {
+	banner := invalidBanner(" INVALID .strithon.yml (audit mode, nothing was blocked)", errs, "Fix .strithon.yml before this repo is enforced.")
+	pipe.Steps = append([]*yaml.Container{{
+		Name:     uniqueStepName(pipe, advisoryStepName),
+		Image:    d.image(),
+		Failure:  "ignore",
+		Commands: []string{fmt.Sprintf("cat <<'%s'\n%s\n%s", bannerDelimiter, banner, bannerDelimiter)},
+	}}, pipe.Steps...)
+}
+
+// invalidBanner lists the problems in .strithon.yml under a header
+func invalidBanner(header string, errs ValidationErrors, footer string) string {
+	lines := []string{
+		"================================================================",
+		header,
+		"================================================================",
+	}
+	for _, err := range errs {
+		lines = append(lines, "  - "+err.Error())
+	}
+	lines = append(lines, "", footer)
+	return strings.Join(lines, "\n")
+}
+
+// image returns the image running the steps added by the extension
+func (d *DenialSettings) image() string {
+	if d.Image == "" {
+		return defaultDenialImage
+	}
+	return d.Image
+}
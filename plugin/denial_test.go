@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenialStep(t *testing.T) {
+	decision := &Decision{
+		ID: "7d1c4f3e",
+		Denials: []Denial{
+			{Account: "222222222222", Environment: "prod", Reason: "repo is not in the prod allow list"},
+		},
+	}
+	step := &yaml.Container{
+		Name:       "deploy-prod",
+		Image:      "plugins/aws-cloudformation:alpha",
+		Privileged: true,
+		Settings:   map[string]*yaml.Parameter{"stack_name": {Value: "app"}},
+		Environment: map[string]*yaml.Variable{
+			"AWS_DEFAULT_REGION":  {Value: "us-east-1"},
+			"DEMO_API_TOKEN_PROD": {Secret: "DEMO_API_TOKEN_PROD"},
+			"AWS_SECRET":          {Secret: "aws_secret"},
+		},
+	}
+	d := &DenialSettings{}
+	if err := d.denialStep(step, "org/repo", decision); err != nil {
+		t.Fatalf("Error building the denial step: %v", err)
+	}
+	assert.Equal(t, "alpine", step.Image)
+	assert.Nil(t, step.Settings)
+	assert.False(t, step.Privileged)
+	assert.Equal(t, map[string]*yaml.Variable{"AWS_DEFAULT_REGION": {Value: "us-east-1"}}, step.Environment)
+	if assert.Len(t, step.Commands, 2) {
+		banner := step.Commands[0]
+		assert.Contains(t, banner, "cat <<'STRITHON_DENIED'")
+		assert.Contains(t, banner, "org/repo is unauthorized to deploy to accounts 222222222222.")
+		assert.Contains(t, banner, "account 222222222222 (environment prod): repo is not in the prod allow list")
+		assert.Contains(t, banner, "Decision ID: 7d1c4f3e")
+		assert.Contains(t, banner, "Update permissions in https://github.com/bellyjay1005/aws-drone-policy.")
+		assert.Equal(t, "exit 1", step.Commands[1])
+	}
+}
+
+func TestDenialStepTemplate(t *testing.T) {
+	d := &DenialSettings{
+		Image:    "registry.example.com/busybox",
+		Link:     "https://access.example.com",
+		Template: "{{ .Repo }} {{ join .Environments \",\" }} {{ .Link }}",
+	}
+	step := &yaml.Container{Name: "deploy"}
+	decision := &Decision{Denials: []Denial{{Account: "1", Environment: "qa"}, {Account: "2", Environment: "prod"}}}
+	if assert.NoError(t, d.denialStep(step, "org/repo", decision)) {
+		assert.Equal(t, "registry.example.com/busybox", step.Image)
+		assert.Contains(t, step.Commands[0], "org/repo prod,qa https://access.example.com")
+	}
+
+	bad := &DenialSettings{Template: "{{ .Repo "}
+	assert.Error(t, bad.Validate())
+}
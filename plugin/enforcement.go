@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// enforcementEnforce replaces denied deploy steps
+	enforcementEnforce = "enforce"
+
+	// enforcementAudit leaves the pipeline alone and adds an advisory step
+	enforcementAudit = "audit"
+
+	// advisoryStepName is the name of the step added in audit mode
+	advisoryStepName = "policy-advisory"
+)
+
+// EnforcementSettings switches denials between enforce and audit mode per
+// namespace or repository
+type EnforcementSettings struct {
+	// Default applies when neither the repo nor its namespace is listed,
+	// enforce unless set
+	Default string `yaml:"default"`
+	// Namespaces maps an org or user to a mode
+	Namespaces map[string]string `yaml:"namespaces"`
+	// Repos maps a namespace/name slug to a mode, winning over Namespaces
+	Repos map[string]string `yaml:"repos"`
+}
+
+// Mode returns the enforcement mode for a repository
+func (e *EnforcementSettings) Mode(namespace, slug string) string {
+	if mode, ok := e.Repos[slug]; ok {
+		return mode
+	}
+	if mode, ok := e.Namespaces[namespace]; ok {
+		return mode
+	}
+	if e.Default != "" {
+		return e.Default
+	}
+	return enforcementEnforce
+}
+
+// Validate checks every mode is known
+func (e *EnforcementSettings) Validate() error {
+	modes := []string{e.Default}
+	for _, mode := range e.Namespaces {
+		modes = append(modes, mode)
+	}
+	for _, mode := range e.Repos {
+		modes = append(modes, mode)
+	}
+	for _, mode := range modes {
+		if mode != "" && mode != enforcementEnforce && mode != enforcementAudit {
+			return fmt.Errorf("Unknown enforcement mode %s", mode)
+		}
+	}
+	return nil
+}
+
+// injectAdvisory adds a non-blocking step listing the steps that would have
+// been replaced, and returns their names
+func injectAdvisory(pipe *yaml.Pipeline, repo string, decision *Decision, build *drone.Build, settings *Settings, generated generatedSteps) []string {
+	names := []string{}
+	for _, step := range deniedSteps(pipe, decision, build, settings.Matchers, generated) {
+		names = append(names, step.Name)
+	}
+	if len(names) == 0 {
+		return names
+	}
+
+	lines := []string{
+		"POLICY ADVISORY (audit mode, nothing was blocked)",
+		fmt.Sprintf("%s would be unauthorized to deploy to accounts %s.", repo, strings.Join(decision.Accounts(), ", ")),
+		fmt.Sprintf("These steps would have been replaced: %s", strings.Join(names, ", ")),
+	}
+	for _, reason := range decision.Reasons() {
+		lines = append(lines, "  - "+reason)
+	}
+	if decision.ID != "" {
+		lines = append(lines, fmt.Sprintf("Decision ID: %s", decision.ID))
+	}
+	image := settings.Denial.Image
+	if image == "" {
+		image = defaultDenialImage
+	}
+	pipe.Steps = append([]*yaml.Container{{
+		Name:     uniqueStepName(pipe, advisoryStepName),
+		Image:    image,
+		Failure:  "ignore",
+		Commands: []string{fmt.Sprintf("cat <<'%s'\n%s\n%s", bannerDelimiter, strings.Join(lines, "\n"), bannerDelimiter)},
+	}}, pipe.Steps...)
+	return names
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	dyaml "github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+const prodDenied = `{"decision_id":"7d1c4f3e","result":{"allow":false,"denials":[{"account":"222222222222","environment":"prod","reason":"repo is not in the prod allow list"}]}}`
+
+func TestEnforcementMode(t *testing.T) {
+	e := EnforcementSettings{
+		Namespaces: map[string]string{"org": "audit"},
+		Repos:      map[string]string{"org/strict": "enforce"},
+	}
+	assert.Equal(t, "audit", e.Mode("org", "org/name"))
+	assert.Equal(t, "enforce", e.Mode("org", "org/strict"))
+	assert.Equal(t, "enforce", e.Mode("other", "other/name"))
+	assert.NoError(t, e.Validate())
+
+	e.Default = "warn"
+	assert.Error(t, e.Validate())
+}
+
+func TestFindAuditMode(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", prodDenied)
+	defer ts.Close()
+
+	settings := &Settings{Enforcement: EnforcementSettings{Namespaces: map[string]string{"org": "audit"}}}
+	p := newFindPlugin(ts, WithSettings(settings))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := dyaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pipe := manifest.Resources[0].(*dyaml.Pipeline)
+	assert.Equal(t, "policy-advisory", pipe.Steps[0].Name)
+	assert.Equal(t, "ignore", pipe.Steps[0].Failure)
+	assert.Contains(t, pipe.Steps[0].Commands[0], "These steps would have been replaced: deploy-prod")
+	for _, step := range pipe.Steps[1:] {
+		assert.NotContains(t, step.Name, "unauthorized")
+	}
+
+	// the same decision is enforced once the org is switched over
+	settings.Enforcement.Namespaces["org"] = "enforce"
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+		assert.NotContains(t, res.Data, "policy-advisory")
+	}
+}
+
+func TestInjectAdvisoryStepName(t *testing.T) {
+	// a repo step named like the advisory keeps its name
+	pipe := &dyaml.Pipeline{Steps: []*dyaml.Container{
+		{Name: advisoryStepName, Image: "golang"},
+		{Name: "deploy-prod", Image: "plugins/aws-cloudformation", Environment: map[string]*dyaml.Variable{"ENVIRON": {Value: "prod"}}},
+	}}
+	decision := &Decision{Environments: []string{"prod"}, Denials: []Denial{{Account: "222222222222", Environment: "prod"}}}
+	injectAdvisory(pipe, "name", decision, &drone.Build{}, &Settings{}, nil)
+	if assert.Len(t, pipe.Steps, 3) {
+		assert.Equal(t, advisoryStepName+"-2", pipe.Steps[0].Name)
+		assert.Equal(t, advisoryStepName, pipe.Steps[1].Name)
+	}
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-go/plugin/environ"
+)
+
+// environPrefix starts the name of every variable the extension sets
+const environPrefix = "STRITHON_"
+
+// unsafeEnvironChars are replaced with _ in variable names
+var unsafeEnvironChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// List returns the variables describing the service and its environments
+// from the repo's .strithon.yml, for the environ extension. A repo without
+// a .strithon.yml, or with an invalid one, gets no variables. The config
+// extension reports the problems in the pipeline instead.
+func (p *Plugin) List(ctx context.Context, req *environ.Request) (vars []*environ.Variable, err error) {
+	configReq := &config.Request{Repo: req.Repo, Build: req.Build}
+	ctx, span := startSpan(ctx, "List", configReq)
+	defer func() { endSpan(span, err) }()
+
+	content, err := p.GetGithubFile(ctx, configReq, req.Repo.Namespace, req.Repo.Name, ".strithon.yml")
+	if isNotFound(err) {
+		return []*environ.Variable{}, nil
+	}
+	if err != nil {
+		logger(ctx).Errorf("Error getting the .strithon.yml of %s: %s", req.Repo.Slug, err)
+		return nil, err
+	}
+	if content == "" {
+		return []*environ.Variable{}, nil
+	}
+	f, err := ParsestrithonFile(content, WithAccountRegistry(&p.settings.Registry))
+	var invalid ValidationErrors
+	if errors.As(err, &invalid) {
+		logger(ctx).Debugf("No variables for the invalid .strithon.yml of %s: %s", req.Repo.Slug, invalid)
+		return []*environ.Variable{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strithonVariables(f, &p.settings.Organizations), nil
+}
+
+// strithonVariables lists the service metadata and the cloud, account and
+// region of each environment
+func strithonVariables(f *StrithonFile, orgs *OrganizationSettings) []*environ.Variable {
+	service := f.Service().Metadata.Service
+	vars := []*environ.Variable{}
+	add := func(name, value string) {
+		if value == "" {
+			return
+		}
+		vars = append(vars, &environ.Variable{Name: environPrefix + name, Data: value})
+	}
+	add("SERVICE_ID", service.ID)
+	add("SERVICE_NAME", service.Name)
+	add("TEAM", service.Team)
+	add("UNIT", service.Unit)
+
+	names := []string{}
+	for _, env := range serviceEnvironments(f) {
+		names = append(names, env.Name)
+		name := environName(env.Name)
+		add("ENV_"+name+"_CLOUD", env.Cloud)
+		add("ENV_"+name+"_ACCOUNT", string(env.Account))
+		add("ENV_"+name+"_OU", env.OU)
+		if env.Cloud == cloudAWS {
+			add("ENV_"+name+"_ACCOUNTS", strings.Join(accountIDs(env, orgs), ","))
+		}
+		add("ENV_"+name+"_PROJECT", env.Project)
+		add("ENV_"+name+"_SUBSCRIPTION", env.Subscription)
+		add("ENV_"+name+"_TENANT", env.Tenant)
+		add("ENV_"+name+"_REGION", env.Region)
+	}
+	add("ENVIRONMENTS", strings.Join(names, ","))
+	return vars
+}
+
+// accountIDs returns every account of an environment, its ou included when
+// it can be resolved
+func accountIDs(env Environment, orgs *OrganizationSettings) []string {
+	accounts, err := orgs.environmentAccounts(env)
+	if err != nil {
+		return nil
+	}
+	ids := []string{}
+	for _, acct := range accounts {
+		ids = append(ids, acct.Account)
+	}
+	return ids
+}
+
+// environName turns an environment name into a part of a variable name
+func environName(name string) string {
+	return unsafeEnvironChars.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// EnvironMap converts variables to the map answered to v1 environ clients
+func EnvironMap(vars []*environ.Variable) map[string]string {
+	m := map[string]string{}
+	for _, v := range vars {
+		m[v.Name] = v.Data
+	}
+	return m
+}
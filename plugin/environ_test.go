@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/drone/drone-go/plugin/environ"
+	"github.com/stretchr/testify/assert"
+)
+
+func environRequest() *environ.Request {
+	req := findRequest()
+	return &environ.Request{Repo: req.Repo, Build: req.Build}
+}
+
+func TestList(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone.yml", "testdata/.strithon-multi-env.yml", "")
+	defer ts.Close()
+
+	vars, err := newFindPlugin(ts).List(noContext, environRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]string{
+		"STRITHON_SERVICE_ID":        "22a1b08d-a330-443c-acfb-f7b55c6a7ac0",
+		"STRITHON_SERVICE_NAME":      "aws-config-check-extension",
+		"STRITHON_TEAM":              "sarahconnor",
+		"STRITHON_UNIT":              "crsl",
+		"STRITHON_ENV_QA_CLOUD":      "aws",
+		"STRITHON_ENV_QA_ACCOUNT":    "111111111111",
+		"STRITHON_ENV_QA_ACCOUNTS":   "111111111111",
+		"STRITHON_ENV_QA_REGION":     "us-east-1",
+		"STRITHON_ENV_PROD_CLOUD":    "aws",
+		"STRITHON_ENV_PROD_ACCOUNT":  "222222222222",
+		"STRITHON_ENV_PROD_ACCOUNTS": "222222222222",
+		"STRITHON_ENV_PROD_REGION":   "us-east-1",
+		"STRITHON_ENVIRONMENTS":      "qa,prod",
+	}, EnvironMap(vars))
+	for _, v := range vars {
+		assert.False(t, v.Mask, v.Name)
+	}
+}
+
+func TestListWithoutStrithonYml(t *testing.T) {
+	for _, file := range []string{"", "testdata/.strithon-invalid.yml"} {
+		ts := newFindServer(t, "testdata/.drone.yml", file, "")
+		vars, err := newFindPlugin(ts).List(noContext, environRequest())
+		assert.NoError(t, err, file)
+		assert.Empty(t, vars, file)
+		ts.Close()
+	}
+}
+
+func TestEnvironName(t *testing.T) {
+	assert.Equal(t, "QA", environName("qa"))
+	assert.Equal(t, "US_PROD_1", environName("us-prod.1"))
+}
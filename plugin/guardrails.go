@@ -0,0 +1,249 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+// Guardrail rules
+const (
+	guardrailPrivileged   = "privileged"
+	guardrailHostVolume   = "host-volume"
+	guardrailDockerSocket = "docker-socket"
+	guardrailHostNetwork  = "host-network"
+	guardrailImage        = "image"
+)
+
+const (
+	// severityError fails the pipeline
+	severityError = "error"
+
+	// severityWarning reports the violation and lets the pipeline run
+	severityWarning = "warning"
+
+	// severityOff disables a rule, rules that are not listed are off
+	severityOff = "off"
+
+	// guardrailsStepName is the step listing the violations
+	guardrailsStepName = "guardrails"
+
+	// dockerSocket is the path of the host's Docker socket
+	dockerSocket = "/var/run/docker.sock"
+)
+
+// knownGuardrails are the rules that can be switched on
+var knownGuardrails = []string{guardrailPrivileged, guardrailHostVolume, guardrailDockerSocket, guardrailHostNetwork, guardrailImage}
+
+// GuardrailSettings flags risky pipeline features before a build runs
+type GuardrailSettings struct {
+	// Rules maps a rule to error, warning or off
+	Rules map[string]string `yaml:"rules"`
+	// Registries are globs of the images allowed by the image rule, *
+	// matches /
+	Registries []string `yaml:"registries"`
+	// Exceptions maps repo slug globs to the rules they are excused from,
+	// * excuses every rule
+	Exceptions map[string][]string `yaml:"exceptions"`
+}
+
+// Validate checks every rule and severity is known
+func (g *GuardrailSettings) Validate() error {
+	for rule, severity := range g.Rules {
+		if !contains(knownGuardrails, rule) {
+			return fmt.Errorf("Unknown guardrail %s, expected one of %s", rule, strings.Join(knownGuardrails, ", "))
+		}
+		if severity != severityError && severity != severityWarning && severity != severityOff {
+			return fmt.Errorf("Unknown severity %s for guardrail %s", severity, rule)
+		}
+	}
+	return nil
+}
+
+// Violation is a pipeline feature flagged by a guardrail
+type Violation struct {
+	Rule     string
+	Severity string
+	Pipeline string
+	Step     string
+	Message  string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: pipeline %s, step %s: %s", v.Severity, v.Pipeline, v.Step, v.Message)
+}
+
+// severity returns the severity of a rule for a repo, off when the rule is
+// not listed or the repo is excused from it
+func (g *GuardrailSettings) severity(rule, slug string) string {
+	severity, ok := g.Rules[rule]
+	if !ok {
+		return severityOff
+	}
+	for pattern, rules := range g.Exceptions {
+		if ok, _ := path.Match(pattern, slug); ok && (contains(rules, rule) || contains(rules, "*")) {
+			return severityOff
+		}
+	}
+	return severity
+}
+
+// lint returns the violations of every step and service of a pipeline
+func (g *GuardrailSettings) lint(pipe *yaml.Pipeline, slug string, mirrors *MirrorSettings) []Violation {
+	hostPaths := map[string]string{}
+	for _, v := range pipe.Volumes {
+		if v != nil && v.HostPath != nil {
+			hostPaths[v.Name] = v.HostPath.Path
+		}
+	}
+	violations := []Violation{}
+	flag := func(rule string, c *yaml.Container, format string, args ...interface{}) {
+		severity := g.severity(rule, slug)
+		if severity == severityOff {
+			return
+		}
+		violations = append(violations, Violation{
+			Rule:     rule,
+			Severity: severity,
+			Pipeline: pipe.Name,
+			Step:     c.Name,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+	for _, c := range append(append([]*yaml.Container{}, pipe.Services...), pipe.Steps...) {
+		if c.Privileged {
+			flag(guardrailPrivileged, c, "privileged mode is not allowed")
+		}
+		if c.Network == "host" {
+			flag(guardrailHostNetwork, c, "network_mode host is not allowed")
+		}
+		for _, mount := range c.Volumes {
+			hostPath, ok := hostPaths[mount.Name]
+			switch {
+			case !ok:
+				continue
+			case path.Clean(hostPath) == dockerSocket:
+				flag(guardrailDockerSocket, c, "mounting the Docker socket is not allowed")
+			default:
+				flag(guardrailHostVolume, c, "host volume %s (%s) is not allowed", mount.Name, hostPath)
+			}
+		}
+		// images are checked as they will be pulled, after mirroring
+		if c.Image != "" {
+			image := c.Image
+			if mirrored, ok := mirrors.rewrite(c.Image); ok {
+				image = mirrored
+			}
+			if !globAny(g.Registries, imageName(image)) {
+				flag(guardrailImage, c, "image %s is not from an approved registry", image)
+			}
+		}
+	}
+	return violations
+}
+
+// lintGuardrails returns the violations of the repo's own pipelines, before
+// the extension adds steps to them
+func (p *Plugin) lintGuardrails(ctx context.Context, content, slug string) ([]Violation, error) {
+	if len(p.settings.Guardrails.Rules) == 0 {
+		return nil, nil
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return nil, err
+	}
+	violations := []Violation{}
+	for _, r := range manifest.Resources {
+		if v, ok := r.(*yaml.Pipeline); ok {
+			violations = append(violations, p.settings.Guardrails.lint(v, slug, &p.settings.Mirrors)...)
+		}
+	}
+	return violations, nil
+}
+
+// applyGuardrails replaces every pipeline with an error violation by a step
+// listing its violations and failing, and adds a non-blocking step listing
+// the warnings of the others
+func (p *Plugin) applyGuardrails(ctx context.Context, content string, violations []Violation) (string, error) {
+	if len(violations) == 0 {
+		return content, nil
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", err
+	}
+	for _, r := range manifest.Resources {
+		pipe, ok := r.(*yaml.Pipeline)
+		if !ok {
+			continue
+		}
+		failed := false
+		lines := []string{}
+		for _, v := range violations {
+			if v.Pipeline != pipe.Name {
+				continue
+			}
+			failed = failed || v.Severity == severityError
+			lines = append(lines, "  - "+v.String())
+		}
+		if len(lines) > 0 {
+			p.settings.Denial.guardrailStep(pipe, lines, failed)
+		}
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, nil
+}
+
+// guardPipelines logs the violations of a build and applies them to its
+// pipelines
+func (p *Plugin) guardPipelines(ctx context.Context, req *config.Request, content string, violations []Violation, event *AuditEvent) (string, error) {
+	if len(violations) == 0 {
+		return content, nil
+	}
+	logger(ctx).WithField("repo", req.Repo.Slug).Warnf("Guardrail violations: %s", strings.Join(event.Guardrails, "; "))
+	return p.applyGuardrails(ctx, content, violations)
+}
+
+// guardrailStep lists the violations of a pipeline. With an error the
+// pipeline is replaced by the step, which fails, otherwise the step is added
+// in front and its failure ignored.
+func (d *DenialSettings) guardrailStep(pipe *yaml.Pipeline, lines []string, failed bool) {
+	header := " GUARDRAIL WARNINGS"
+	footer := "The pipeline ran anyway. These will be blocked once the rules are enforced."
+	if failed {
+		header = " BLOCKED BY GUARDRAILS"
+		footer = "Nothing ran. Remove these features or ask the security team for an exception."
+	}
+	banner := append([]string{
+		"================================================================",
+		header,
+		"================================================================",
+	}, lines...)
+	banner = append(banner, "", footer)
+	image := d.Image
+	if image == "" {
+		image = defaultDenialImage
+	}
+	step := &yaml.Container{
+		Name:     guardrailsStepName,
+		Image:    image,
+		Commands: []string{fmt.Sprintf("cat <<'%s'\n%s\n%s", bannerDelimiter, strings.Join(banner, "\n"), bannerDelimiter)},
+	}
+	if failed {
+		step.Commands = append(step.Commands, "exit 1")
+		pipe.Services = nil
+		pipe.Volumes = nil
+		pipe.Steps = []*yaml.Container{step}
+		return
+	}
+	step.Name = uniqueStepName(pipe, guardrailsStepName)
+	step.Failure = "ignore"
+	pipe.Steps = append([]*yaml.Container{step}, pipe.Steps...)
+}
@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	dyaml "github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func guardrailSettings() GuardrailSettings {
+	return GuardrailSettings{
+		Rules: map[string]string{
+			guardrailPrivileged:   severityError,
+			guardrailDockerSocket: severityError,
+			guardrailHostVolume:   severityWarning,
+			guardrailHostNetwork:  severityWarning,
+			guardrailImage:        severityWarning,
+		},
+		Registries: []string{"golang", "redis", "plugins/*"},
+	}
+}
+
+func TestLintGuardrails(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-guardrails.yml", "", "")
+	defer ts.Close()
+	p := newFindPlugin(ts, WithSettings(&Settings{Guardrails: guardrailSettings()}))
+
+	b, _ := ioutil.ReadFile("testdata/.drone-guardrails.yml")
+	content := string(b)
+	violations, err := p.lintGuardrails(noContext, content, "org/name")
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := []string{}
+	for _, v := range violations {
+		lines = append(lines, v.String())
+	}
+	assert.Equal(t, []string{
+		"warning: pipeline build, step test: host volume gocache (/var/cache/go) is not allowed",
+		"error: pipeline build, step publish: privileged mode is not allowed",
+		"error: pipeline build, step publish: mounting the Docker socket is not allowed",
+		"warning: pipeline build, step e2e: network_mode host is not allowed",
+		"warning: pipeline build, step e2e: image ghcr.io/example/e2e:1.0 is not from an approved registry",
+	}, lines)
+
+	// exceptions excuse a repo from rules
+	p.settings.Guardrails.Exceptions = map[string][]string{"org/*": {guardrailPrivileged, guardrailDockerSocket}, "org/name": {guardrailImage}}
+	violations, _ = p.lintGuardrails(noContext, content, "org/name")
+	assert.Len(t, violations, 2)
+	p.settings.Guardrails.Exceptions = map[string][]string{"org/name": {"*"}}
+	violations, _ = p.lintGuardrails(noContext, content, "org/name")
+	assert.Len(t, violations, 0)
+
+	// images are checked as they will be pulled, after mirroring
+	p.settings.Guardrails.Exceptions = nil
+	p.settings.Guardrails.Registries = []string{"mirror.example.com/*"}
+	violations, _ = p.lintGuardrails(noContext, content, "org/name")
+	assert.Len(t, imageViolations(violations), 5)
+	p.settings.Mirrors = mirrorSettings()
+	violations, _ = p.lintGuardrails(noContext, content, "org/name")
+	assert.Len(t, imageViolations(violations), 0)
+	p.settings.Mirrors = MirrorSettings{}
+
+	// nothing is linted without rules
+	p.settings.Guardrails = GuardrailSettings{}
+	violations, _ = p.lintGuardrails(noContext, content, "org/name")
+	assert.Len(t, violations, 0)
+}
+
+func imageViolations(violations []Violation) []Violation {
+	images := []Violation{}
+	for _, v := range violations {
+		if v.Rule == guardrailImage {
+			images = append(images, v)
+		}
+	}
+	return images
+}
+
+func TestGuardrailSettingsValidate(t *testing.T) {
+	g := guardrailSettings()
+	assert.NoError(t, g.Validate())
+	g.Rules["root-user"] = severityError
+	assert.Error(t, g.Validate())
+	delete(g.Rules, "root-user")
+	g.Rules[guardrailImage] = "block"
+	assert.EqualError(t, g.Validate(), "Unknown severity block for guardrail image")
+}
+
+func TestFindGuardrails(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-guardrails.yml", "", "")
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	settings := &Settings{Guardrails: guardrailSettings()}
+	p := newFindPlugin(ts, WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := dyaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the build pipeline has errors and is replaced
+	build := manifest.Resources[0].(*dyaml.Pipeline)
+	if assert.Len(t, build.Steps, 1) {
+		assert.Equal(t, guardrailsStepName, build.Steps[0].Name)
+		assert.Contains(t, build.Steps[0].Commands[0], "BLOCKED BY GUARDRAILS")
+		assert.Contains(t, build.Steps[0].Commands[0], "step publish: privileged mode is not allowed")
+		assert.Equal(t, "exit 1", build.Steps[0].Commands[1])
+	}
+	assert.Empty(t, build.Services)
+	assert.Empty(t, build.Volumes)
+	// the lint pipeline is left alone
+	lint := manifest.Resources[1].(*dyaml.Pipeline)
+	assert.Equal(t, "vet", lint.Steps[0].Name)
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Len(t, e.Guardrails, 5)
+	}
+
+	// warnings only add a step
+	for rule := range settings.Guardrails.Rules {
+		settings.Guardrails.Rules[rule] = severityWarning
+	}
+	res, err = p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, _ = dyaml.Parse(strings.NewReader(res.Data))
+	build = manifest.Resources[0].(*dyaml.Pipeline)
+	assert.Equal(t, guardrailsStepName, build.Steps[0].Name)
+	assert.Equal(t, "ignore", build.Steps[0].Failure)
+	assert.Contains(t, build.Steps[0].Commands[0], "GUARDRAIL WARNINGS")
+	assert.Equal(t, "publish", build.Steps[2].Name)
+	assert.True(t, build.Steps[2].Privileged)
+}
+
+func TestFindGuardrailsInvalidStrithonYml(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-guardrails.yml", "testdata/.strithon-invalid.yml", "")
+	defer ts.Close()
+
+	// an invalid file in audit mode must not skip the guardrails
+	settings := &Settings{
+		Guardrails:  guardrailSettings(),
+		Enforcement: EnforcementSettings{Namespaces: map[string]string{"org": enforcementAudit}},
+	}
+	p := newFindPlugin(ts, WithSettings(settings))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := dyaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	build := manifest.Resources[0].(*dyaml.Pipeline)
+	if assert.Len(t, build.Steps, 1) {
+		assert.Equal(t, guardrailsStepName, build.Steps[0].Name)
+		assert.Contains(t, build.Steps[0].Commands[0], "step publish: privileged mode is not allowed")
+	}
+}
+
+func TestGuardrailStepName(t *testing.T) {
+	// a repo step named like the guardrails step keeps its name
+	pipe := &dyaml.Pipeline{Steps: []*dyaml.Container{{Name: guardrailsStepName}}}
+	(&DenialSettings{}).guardrailStep(pipe, []string{"  - warning"}, false)
+	if assert.Len(t, pipe.Steps, 2) {
+		assert.Equal(t, guardrailsStepName+"-2", pipe.Steps[0].Name)
+		assert.Equal(t, guardrailsStepName, pipe.Steps[1].Name)
+	}
+}
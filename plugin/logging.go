@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// redacted replaces secret values in log lines
+	redacted = "[REDACTED]"
+
+	// requestIDField is the log field holding the correlation id
+	requestIDField = "request_id"
+
+	// RequestIDHeader is read from incoming requests and echoed back
+	RequestIDHeader = "X-Request-Id"
+)
+
+// requestIDHeaders are checked in order for a correlation id
+var requestIDHeaders = []string{RequestIDHeader, "X-Drone-Request-Id", "X-Amzn-Trace-Id"}
+
+// secretKey matches field names whose values are never logged
+var secretKey = regexp.MustCompile(`(?i)(secret|token|password|authorization|signature|credential|api_?key)`)
+
+// secretPatterns find secret values inside free text
+var secretPatterns = []struct {
+	expr    *regexp.Regexp
+	replace string
+}{
+	// "client_secret":"...", also when the json is quoted
+	{regexp.MustCompile(`(?i)(\\?"[a-z_]*(?:secret|token|password)[a-z_]*\\?"\s*:\s*\\?")[^"\\]*`), "${1}" + redacted},
+	// client_secret=... and client_secret: ...
+	{regexp.MustCompile(`(?i)\b([a-z_]*(?:secret|token|password)[a-z_]*\s*[=:]\s*)[^\s,&"}]+`), "${1}" + redacted},
+	// Authorization: Bearer ...
+	{regexp.MustCompile(`(?i)\b(bearer|basic|signature)\s+[A-Za-z0-9\-._~+/=,"]+`), "${1} " + redacted},
+	// JSON web tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	// GitHub tokens
+	{regexp.MustCompile(`\b(?:gh[pousr]|github_pat)_[A-Za-z0-9_]{20,}`), redacted},
+	// AWS access key ids
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), redacted},
+}
+
+// Redact removes secret values from a string
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.expr.ReplaceAllString(s, p.replace)
+	}
+	return s
+}
+
+// redactFormatter redacts each entry before handing it to the next
+// formatter
+type redactFormatter struct {
+	next logrus.Formatter
+}
+
+// NewLogFormatter returns a formatter that redacts secrets, writing JSON
+// unless text is asked for
+func NewLogFormatter(text bool) logrus.Formatter {
+	var next logrus.Formatter = &logrus.JSONFormatter{}
+	if text {
+		next = &logrus.TextFormatter{}
+	}
+	return &redactFormatter{next: next}
+}
+
+func (f *redactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	clean := *entry
+	clean.Message = Redact(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		clean.Data[k] = v
+		switch {
+		case secretKey.MatchString(k):
+			clean.Data[k] = redacted
+		case k == logrus.ErrorKey:
+			if err, ok := v.(error); ok {
+				clean.Data[k] = Redact(err.Error())
+			}
+		default:
+			if s := fmt.Sprint(v); Redact(s) != s {
+				clean.Data[k] = Redact(s)
+			}
+		}
+	}
+	return f.next.Format(&clean)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID stores the correlation id of a config request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the correlation id stored in the context
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDFromHeader returns the correlation id sent with a request, or an
+// empty string
+func RequestIDFromHeader(h http.Header) string {
+	for _, name := range requestIDHeaders {
+		if id := h.Get(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// NewRequestID returns a random correlation id
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDHandler gives every request a correlation id, taken from its
+// headers when present, and echoes it in the response
+func RequestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := RequestIDFromHeader(r.Header)
+		if id == "" {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// logger returns a log entry carrying the correlation id of the request
+func logger(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if ctx == nil {
+		return entry
+	}
+	if id := RequestID(ctx); id != "" {
+		entry = entry.WithField(requestIDField, id)
+	}
+	return entry
+}
@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+// StepMatcher decides whether a pipeline step is a deploy step. Every
+// criterion that is set has to match, and a criterion matches when any of
+// its patterns does.
+type StepMatcher struct {
+	Name string `yaml:"name"`
+	// Environment is the environment the matched steps deploy to. When empty
+	// it is worked out from the step itself.
+	Environment string `yaml:"environment"`
+	// Images are globs matched against the image with and without its tag
+	Images []string `yaml:"images"`
+	// Steps are globs matched against the step name
+	Steps []string `yaml:"steps"`
+	// Settings are plugin settings keys the step must set
+	Settings []string `yaml:"settings"`
+	// Variables are environment variables the step must set
+	Variables []string `yaml:"variables"`
+	// Commands are regular expressions matched against each command
+	Commands []string `yaml:"commands"`
+}
+
+// defaultMatchers keep the original behaviour of treating every plugin
+// image as a deploy step
+var defaultMatchers = []StepMatcher{
+	{Name: "plugin", Images: []string{"*plugin*"}},
+}
+
+// Validate checks the matcher can be used
+func (m *StepMatcher) Validate() error {
+	if len(m.Images)+len(m.Steps)+len(m.Settings)+len(m.Variables)+len(m.Commands) == 0 {
+		return fmt.Errorf("Matcher %s has no criteria", m.Name)
+	}
+	for _, expr := range m.Commands {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("Matcher %s has an invalid command pattern: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the step satisfies every criterion of the matcher
+func (m *StepMatcher) Match(step *yaml.Container) bool {
+	if len(m.Images) > 0 && !globAny(m.Images, step.Image) && !globAny(m.Images, imageName(step.Image)) {
+		return false
+	}
+	if len(m.Steps) > 0 && !globAny(m.Steps, step.Name) {
+		return false
+	}
+	if len(m.Settings) > 0 && !hasAnyKey(m.Settings, func(k string) bool { _, ok := step.Settings[k]; return ok }) {
+		return false
+	}
+	if len(m.Variables) > 0 && !hasAnyKey(m.Variables, func(k string) bool { _, ok := step.Environment[k]; return ok }) {
+		return false
+	}
+	if len(m.Commands) > 0 && !commandsMatch(m.Commands, step.Commands) {
+		return false
+	}
+	return true
+}
+
+// deployStep returns whether the step is a deploy step and, when it can be
+// worked out, the environment it deploys to
+func deployStep(step *yaml.Container, build *drone.Build, envs []string, matchers []StepMatcher) (bool, string) {
+	if len(matchers) == 0 {
+		matchers = defaultMatchers
+	}
+	for _, m := range matchers {
+		if !m.Match(step) {
+			continue
+		}
+		if m.Environment != "" {
+			return true, strings.ToLower(m.Environment)
+		}
+		return true, stepEnvironment(step, build, envs)
+	}
+	return false, ""
+}
+
+// imageName strips the tag or digest from an image
+func imageName(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// globAny reports whether the value matches one of the globs, where * also
+// matches slashes so a glob can span registry and repository
+func globAny(globs []string, value string) bool {
+	for _, glob := range globs {
+		expr := strings.Replace(regexp.QuoteMeta(glob), `\*`, ".*", -1)
+		expr = strings.Replace(expr, `\?`, ".", -1)
+		if ok, _ := regexp.MatchString("^"+expr+"$", value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyKey(keys []string, has func(string) bool) bool {
+	for _, k := range keys {
+		if has(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func commandsMatch(exprs []string, commands []string) bool {
+	for _, expr := range exprs {
+		for _, command := range commands {
+			if ok, _ := regexp.MatchString(expr, command); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepMatcher(t *testing.T) {
+	awsCli := &yaml.Container{
+		Name:     "publish",
+		Image:    "amazon/aws-cli:2.0.6",
+		Commands: []string{"aws cloudformation deploy --stack-name app"},
+		Environment: map[string]*yaml.Variable{
+			"AWS_ROLE_ARN": {Value: "arn:aws:iam::111111111111:role/deploy"},
+		},
+	}
+	slack := &yaml.Container{
+		Name:     "notify",
+		Image:    "plugins/slack",
+		Settings: map[string]*yaml.Parameter{"webhook": {Secret: "slack"}},
+	}
+	cfn := &yaml.Container{
+		Name:     "deploy-prod",
+		Image:    "plugins/aws-cloudformation:alpha",
+		Settings: map[string]*yaml.Parameter{"stack_name": {Value: "app"}},
+	}
+	cases := []struct {
+		name    string
+		matcher StepMatcher
+		step    *yaml.Container
+		want    bool
+	}{
+		{"image without tag", StepMatcher{Images: []string{"amazon/aws-cli"}}, awsCli, true},
+		{"image glob across slash", StepMatcher{Images: []string{"*aws-cloudformation*"}}, cfn, true},
+		{"image glob misses slack", StepMatcher{Images: []string{"plugins/aws-*"}}, slack, false},
+		{"step name", StepMatcher{Steps: []string{"deploy-*"}}, cfn, true},
+		{"settings key", StepMatcher{Settings: []string{"stack_name"}}, cfn, true},
+		{"settings key missing", StepMatcher{Settings: []string{"stack_name"}}, slack, false},
+		{"variable", StepMatcher{Variables: []string{"AWS_ROLE_ARN"}}, awsCli, true},
+		{"command", StepMatcher{Commands: []string{`^aws (cloudformation|s3) `}}, awsCli, true},
+		{"every criterion must match", StepMatcher{Images: []string{"amazon/*"}, Commands: []string{"terraform"}}, awsCli, false},
+		{"legacy default", defaultMatchers[0], slack, true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.matcher.Match(c.step), c.name)
+	}
+}
+
+func TestDeployStep(t *testing.T) {
+	matchers := []StepMatcher{
+		{Name: "prod-stack", Environment: "prod", Steps: []string{"*-prod"}},
+		{Name: "cloudformation", Images: []string{"plugins/aws-cloudformation"}},
+	}
+	step := &yaml.Container{
+		Name:        "deploy-qa",
+		Image:       "plugins/aws-cloudformation:alpha",
+		Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "qa"}},
+	}
+	deploy, env := deployStep(step, &drone.Build{}, nil, matchers)
+	assert.True(t, deploy)
+	assert.Equal(t, "qa", env)
+
+	step.Name = "deploy-prod"
+	deploy, env = deployStep(step, &drone.Build{}, nil, matchers)
+	assert.True(t, deploy)
+	assert.Equal(t, "prod", env)
+
+	deploy, _ = deployStep(&yaml.Container{Name: "test", Image: "golang"}, &drone.Build{}, nil, matchers)
+	assert.False(t, deploy)
+}
+
+func TestInjectStepsScoped(t *testing.T) {
+	pipe := &yaml.Pipeline{
+		Steps: []*yaml.Container{
+			{Name: "test", Image: "golang"},
+			{Name: "deploy-qa", Image: "plugins/aws-cloudformation", Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "qa"}}},
+			{Name: "deploy-pr", Image: "plugins/aws-cloudformation", Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "pr"}}},
+		},
+	}
+	matchers := []StepMatcher{{Images: []string{"plugins/aws-*"}}}
+	injectSteps(pipe, "DEMO_API_TOKEN_QA", "qa", matchers, &drone.Build{})
+	assert.Contains(t, pipe.Steps[0].Environment, "DEMO_API_TOKEN_QA")
+	assert.Contains(t, pipe.Steps[1].Environment, "DEMO_API_TOKEN_QA")
+	assert.NotContains(t, pipe.Steps[2].Environment, "DEMO_API_TOKEN_QA")
+
+	// without matchers every step keeps getting every token
+	injectSteps(pipe, "DEMO_API_TOKEN", "pr", nil, &drone.Build{})
+	assert.Contains(t, pipe.Steps[1].Environment, "DEMO_API_TOKEN")
+}
+
+func TestParseSettingsMatchers(t *testing.T) {
+	settings, err := ParseSettings([]byte(`
+matchers:
+  - name: aws-cli
+    images: ["amazon/aws-cli*"]
+    commands: ["^aws "]
+`))
+	if assert.NoError(t, err) {
+		assert.Len(t, settings.Matchers, 1)
+	}
+	_, err = ParseSettings([]byte(`matchers: [{name: broken, commands: ["("]}]`))
+	assert.Error(t, err)
+	_, err = ParseSettings([]byte(`matchers: [{name: empty}]`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// metricsNamespace prefixes every metric name
+	metricsNamespace = "strithon"
+
+	// emfNamespace is the CloudWatch namespace of the log based metrics
+	emfNamespace = "Strithon/ConfigExtension"
+)
+
+// Upstream services called while serving a config request
+const (
+	upstreamGithub = "github"
+	upstreamSSM    = "ssm"
+	upstreamAuth0  = "auth0"
+	upstreamDrone  = "drone"
+	upstreamAuth   = "auth"
+	upstreamShadow = "auth-shadow"
+)
+
+// Registry holds the extension metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Duration of calls to upstream services by outcome.",
+	}, []string{"upstream", "outcome"})
+
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decisions_total",
+		Help:      "Config requests by policy decision.",
+	}, []string{"decision"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injected_tokens_total",
+		Help:      "Api tokens injected into pipelines by environment.",
+	}, []string{"environment"})
+
+	cacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+)
+
+func init() {
+	Registry.MustRegister(upstreamDuration, decisionsTotal, tokensTotal, cacheTotal)
+}
+
+// observeUpstream records the duration and outcome of an upstream call
+func observeUpstream(upstream string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	seconds := time.Since(start).Seconds()
+	upstreamDuration.WithLabelValues(upstream, outcome).Observe(seconds)
+	emf.add("upstream_request_duration_seconds", "Seconds", seconds, "upstream", upstream, "outcome", outcome)
+}
+
+// countDecision counts a config request by the decision recorded for it
+func countDecision(decision string) {
+	decisionsTotal.WithLabelValues(decision).Inc()
+	emf.add("decisions", "Count", 1, "decision", decision)
+}
+
+// countToken counts a token injected for an environment
+func countToken(env string) {
+	tokensTotal.WithLabelValues(env).Inc()
+	emf.add("injected_tokens", "Count", 1, "environment", env)
+}
+
+// CountCache counts a cache lookup, the hit rate is hits over all lookups
+func CountCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheTotal.WithLabelValues(cache, result).Inc()
+	emf.add("cache_requests", "Count", 1, "cache", cache, "result", result)
+}
+
+// emf buffers observations for CloudWatch embedded metric format logs. It
+// only buffers once enabled so a long running server does not grow it.
+var emf = &emfBuffer{}
+
+type emfBuffer struct {
+	mu      sync.Mutex
+	enabled bool
+	series  map[string]*emfSeries
+}
+
+// emfSeries is one metric with one set of dimension values
+type emfSeries struct {
+	name       string
+	unit       string
+	dimensions []string
+	values     []float64
+}
+
+// EnableEMF starts buffering metrics for FlushEMF
+func EnableEMF() {
+	emf.mu.Lock()
+	defer emf.mu.Unlock()
+	emf.enabled = true
+}
+
+func (b *emfBuffer) add(name, unit string, value float64, dimensions ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.enabled {
+		return
+	}
+	if b.series == nil {
+		b.series = map[string]*emfSeries{}
+	}
+	key := name + "\x00" + strings.Join(dimensions, "\x00")
+	s, ok := b.series[key]
+	if !ok {
+		s = &emfSeries{name: name, unit: unit, dimensions: dimensions}
+		b.series[key] = s
+	}
+	s.values = append(s.values, value)
+}
+
+// FlushEMF writes the metrics observed since the last flush as CloudWatch
+// embedded metric format JSON lines, one per metric and dimension set
+func FlushEMF(w io.Writer) error {
+	emf.mu.Lock()
+	series := emf.series
+	emf.series = nil
+	emf.mu.Unlock()
+
+	keys := []string{}
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for _, key := range keys {
+		s := series[key]
+		doc := map[string]interface{}{}
+		names := []string{}
+		for i := 0; i+1 < len(s.dimensions); i += 2 {
+			names = append(names, s.dimensions[i])
+			doc[s.dimensions[i]] = s.dimensions[i+1]
+		}
+		doc["_aws"] = map[string]interface{}{
+			"Timestamp": now,
+			"CloudWatchMetrics": []interface{}{map[string]interface{}{
+				"Namespace":  emfNamespace,
+				"Dimensions": [][]string{names},
+				"Metrics":    []interface{}{map[string]string{"Name": s.name, "Unit": s.unit}},
+			}},
+		}
+		doc[s.name] = s.values
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
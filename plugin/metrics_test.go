@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	before := testutil.ToFloat64(decisionsTotal.WithLabelValues(auditDenied))
+	countDecision(auditDenied)
+	assert.Equal(t, before+1, testutil.ToFloat64(decisionsTotal.WithLabelValues(auditDenied)))
+
+	before = testutil.ToFloat64(tokensTotal.WithLabelValues("qa"))
+	countToken("qa")
+	assert.Equal(t, before+1, testutil.ToFloat64(tokensTotal.WithLabelValues("qa")))
+
+	before = testutil.ToFloat64(cacheTotal.WithLabelValues("settings", "hit"))
+	CountCache("settings", true)
+	assert.Equal(t, before+1, testutil.ToFloat64(cacheTotal.WithLabelValues("settings", "hit")))
+
+	observeUpstream(upstreamGithub, time.Now(), errors.New("boom"))
+	families, err := Registry.Gather()
+	if !assert.NoError(t, err) {
+		return
+	}
+	found := false
+	for _, f := range families {
+		if f.GetName() != "strithon_upstream_request_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["upstream"] == upstreamGithub && labels["outcome"] == "error" {
+				found = m.GetHistogram().GetSampleCount() > 0
+			}
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestFlushEMF(t *testing.T) {
+	EnableEMF()
+	defer func() { emf.enabled = false }()
+	FlushEMF(&bytes.Buffer{})
+
+	observeUpstream(upstreamAuth, time.Now(), nil)
+	observeUpstream(upstreamAuth, time.Now(), nil)
+	countDecision(auditAllowed)
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, FlushEMF(&buf)) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	var decision map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &decision))
+	assert.Equal(t, "allowed", decision["decision"])
+	assert.Equal(t, []interface{}{1.0}, decision["decisions"])
+
+	var upstream struct {
+		AWS struct {
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		Upstream string    `json:"upstream"`
+		Outcome  string    `json:"outcome"`
+		Values   []float64 `json:"upstream_request_duration_seconds"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &upstream))
+	assert.Equal(t, "auth", upstream.Upstream)
+	assert.Equal(t, "success", upstream.Outcome)
+	assert.Len(t, upstream.Values, 2)
+	if assert.Len(t, upstream.AWS.CloudWatchMetrics, 1) {
+		m := upstream.AWS.CloudWatchMetrics[0]
+		assert.Equal(t, emfNamespace, m.Namespace)
+		assert.Equal(t, [][]string{{"upstream", "outcome"}}, m.Dimensions)
+		assert.Equal(t, "Seconds", m.Metrics[0].Unit)
+	}
+
+	// the buffer is empty after a flush
+	buf.Reset()
+	FlushEMF(&buf)
+	assert.Empty(t, buf.String())
+}
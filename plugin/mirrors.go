@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// dockerHub is the registry of images named without one
+	dockerHub = "docker.io"
+
+	// dockerHubLibrary holds the official images such as golang or alpine
+	dockerHubLibrary = "docker.io/library"
+)
+
+// MirrorRule rewrites images under an upstream registry or repository to a
+// mirror
+type MirrorRule struct {
+	// From is a registry such as docker.io or ghcr.io, or a repository such
+	// as golang or plugins/docker
+	From string `yaml:"from"`
+	// To replaces From, such as mirror.example.com/hub
+	To string `yaml:"to"`
+}
+
+// MirrorSettings rewrites the images of the returned pipelines
+type MirrorSettings struct {
+	Rewrites []MirrorRule `yaml:"rewrites"`
+}
+
+// Validate checks every rewrite names an upstream and a mirror without a tag
+func (m *MirrorSettings) Validate() error {
+	for _, r := range m.Rewrites {
+		if r.From == "" || r.To == "" {
+			return fmt.Errorf("Mirror rewrite %q -> %q needs both from and to", r.From, r.To)
+		}
+		if imageName(r.From) != r.From || imageName(r.To) != r.To {
+			return fmt.Errorf("Mirror rewrite %s -> %s may not have a tag or digest", r.From, r.To)
+		}
+	}
+	return nil
+}
+
+// isRegistry reports whether the first part of an image name is a registry
+// host rather than a Docker Hub namespace
+func isRegistry(part string) bool {
+	return strings.ContainsAny(part, ".:") || part == "localhost"
+}
+
+// fullImageName expands a Docker Hub short name so golang becomes
+// docker.io/library/golang and plugins/docker docker.io/plugins/docker
+func fullImageName(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	switch {
+	case len(parts) == 1 && isRegistry(name):
+		return name
+	case len(parts) == 1:
+		return dockerHubLibrary + "/" + name
+	case parts[0] == "index.docker.io":
+		return dockerHub + "/" + parts[1]
+	case isRegistry(parts[0]):
+		return name
+	default:
+		return dockerHub + "/" + name
+	}
+}
+
+// rewrite returns the mirrored image, keeping its tag or digest. The rule
+// with the longest matching From wins.
+func (m *MirrorSettings) rewrite(image string) (string, bool) {
+	// exec and ssh pipelines run without images
+	if image == "" {
+		return image, false
+	}
+	name := imageName(image)
+	full := fullImageName(name)
+	from, to := "", ""
+	for _, r := range m.Rewrites {
+		prefix := fullImageName(r.From)
+		if full != prefix && !strings.HasPrefix(full, prefix+"/") {
+			continue
+		}
+		if len(prefix) > len(from) {
+			from, to = prefix, r.To
+		}
+	}
+	if from == "" {
+		return image, false
+	}
+	mirrored := to + full[len(from):] + image[len(name):]
+	return mirrored, mirrored != image
+}
+
+// mirrorImages rewrites the step and service images of every pipeline and
+// returns the rewrites made
+func (p *Plugin) mirrorImages(ctx context.Context, content string) (string, []string, error) {
+	if len(p.settings.Mirrors.Rewrites) == 0 {
+		return content, nil, nil
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
+	}
+	rewrites := []string{}
+	seen := map[string]bool{}
+	for _, r := range manifest.Resources {
+		pipe, ok := r.(*yaml.Pipeline)
+		if !ok {
+			continue
+		}
+		for _, c := range append(append([]*yaml.Container{}, pipe.Services...), pipe.Steps...) {
+			mirrored, ok := p.settings.Mirrors.rewrite(c.Image)
+			if !ok {
+				continue
+			}
+			if rewrite := c.Image + " -> " + mirrored; !seen[rewrite] {
+				seen[rewrite] = true
+				rewrites = append(rewrites, rewrite)
+			}
+			c.Image = mirrored
+		}
+	}
+	if len(rewrites) == 0 {
+		return content, nil, nil
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, rewrites, nil
+}
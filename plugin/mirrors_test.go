@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	dyaml "github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func mirrorSettings() MirrorSettings {
+	return MirrorSettings{Rewrites: []MirrorRule{
+		{From: "docker.io", To: "mirror.example.com/hub"},
+		{From: "docker.io/plugins", To: "mirror.example.com/drone-plugins"},
+		{From: "ghcr.io/example", To: "mirror.example.com/example"},
+	}}
+}
+
+func TestMirrorRewrite(t *testing.T) {
+	m := mirrorSettings()
+	tests := []struct {
+		image, want string
+	}{
+		{"golang", "mirror.example.com/hub/library/golang"},
+		{"golang:1.13", "mirror.example.com/hub/library/golang:1.13"},
+		{"alpine@sha256:abc", "mirror.example.com/hub/library/alpine@sha256:abc"},
+		{"library/redis:6", "mirror.example.com/hub/library/redis:6"},
+		{"index.docker.io/bitnami/redis", "mirror.example.com/hub/bitnami/redis"},
+		// the longest from wins
+		{"plugins/docker:19", "mirror.example.com/drone-plugins/docker:19"},
+		{"ghcr.io/example/e2e:1.0@sha256:abc", "mirror.example.com/example/e2e:1.0@sha256:abc"},
+		// only whole path segments match
+		{"ghcr.io/examples/e2e", "ghcr.io/examples/e2e"},
+		{"localhost:5000/tool:1", "localhost:5000/tool:1"},
+		// mirrored images are left alone
+		{"mirror.example.com/hub/library/golang", "mirror.example.com/hub/library/golang"},
+		// exec and ssh steps have no image
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, ok := m.rewrite(test.image)
+		assert.Equal(t, test.want, got, test.image)
+		assert.Equal(t, test.want != test.image, ok, test.image)
+	}
+}
+
+func TestMirrorSettingsValidate(t *testing.T) {
+	m := mirrorSettings()
+	assert.NoError(t, m.Validate())
+	m.Rewrites = append(m.Rewrites, MirrorRule{From: "quay.io"})
+	assert.Error(t, m.Validate())
+	m.Rewrites[len(m.Rewrites)-1].To = "mirror.example.com/quay:latest"
+	assert.EqualError(t, m.Validate(), "Mirror rewrite quay.io -> mirror.example.com/quay:latest may not have a tag or digest")
+}
+
+func TestFindMirrors(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "", "")
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	settings := &Settings{
+		Mirrors: mirrorSettings(),
+		Require: RequireSettings{Namespaces: map[string]bool{"org": true}},
+	}
+	p := newFindPlugin(ts, WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := dyaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pipe := manifest.Resources[0].(*dyaml.Pipeline)
+	images := []string{}
+	for _, step := range pipe.Steps {
+		images = append(images, step.Image)
+	}
+	// the denial steps added by the extension are mirrored too
+	assert.Equal(t, []string{
+		"mirror.example.com/hub/library/golang",
+		"mirror.example.com/hub/library/alpine",
+		"mirror.example.com/hub/library/alpine",
+		"mirror.example.com/hub/library/golang",
+	}, images)
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, []string{
+			"golang -> mirror.example.com/hub/library/golang",
+			"alpine -> mirror.example.com/hub/library/alpine",
+		}, e.Mirrored)
+	}
+
+	// without rewrites the images are left alone
+	p = newFindPlugin(ts)
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.NotContains(t, res.Data, "mirror.example.com")
+		assert.Contains(t, res.Data, "plugins/aws-cloudformation:alpha")
+	}
+}
+
+func TestMirrorImagesWithoutImage(t *testing.T) {
+	p := &Plugin{settings: &Settings{Mirrors: mirrorSettings()}}
+	content := "---\nkind: pipeline\ntype: exec\nname: default\nsteps:\n- name: build\n  commands:\n  - make\n"
+	got, mirrored, err := p.mirrorImages(noContext, content)
+	if assert.NoError(t, err) {
+		assert.Equal(t, content, got)
+		assert.Empty(t, mirrored)
+	}
+}
@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultNotifyRetries is the number of retries when none is set
+	defaultNotifyRetries = 3
+
+	// defaultNotifyBackoff is the wait before the first retry, it doubles
+	// with each retry
+	defaultNotifyBackoff = time.Second
+
+	// defaultNotifyWait bounds the wait for deliveries when none is set
+	defaultNotifyWait = 500 * time.Millisecond
+)
+
+// notifyDecisions are the audit decisions that send a notification
+var notifyDecisions = []string{auditDenied, auditFailOpen, auditMissing, auditError}
+
+// NotifySettings selects where denials and policy errors are announced
+type NotifySettings struct {
+	// Teams maps the ms_team of a .strithon.yml, as name/channel or just
+	// name, to a Microsoft Teams incoming webhook
+	Teams map[string]string `yaml:"teams"`
+	// Webhook receives every notification as JSON
+	Webhook string `yaml:"webhook"`
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of times a failed delivery is tried again
+	Retries int `yaml:"retries"`
+	// Backoff is the wait before the first retry
+	Backoff time.Duration `yaml:"backoff"`
+	// Wait bounds how long a Lambda invocation waits for its deliveries
+	// before responding
+	Wait time.Duration `yaml:"wait"`
+}
+
+// WaitTimeout returns how long an invocation waits for its deliveries
+func (s *NotifySettings) WaitTimeout() time.Duration {
+	if s.Wait == 0 {
+		return defaultNotifyWait
+	}
+	return s.Wait
+}
+
+// teamsWebhook returns the Teams webhook of a team and channel, the webhook
+// of the channel wins over the one of the team
+func (s *NotifySettings) teamsWebhook(team, channel string) string {
+	if url, ok := s.Teams[team+"/"+channel]; ok && channel != "" {
+		return url
+	}
+	return s.Teams[team]
+}
+
+// Notification describes a denied deploy or a policy error
+type Notification struct {
+	Repo       string   `json:"repo"`
+	Commit     string   `json:"commit,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	Event      string   `json:"event,omitempty"`
+	Link       string   `json:"link,omitempty"`
+	Decision   string   `json:"decision"`
+	DecisionID string   `json:"decision_id,omitempty"`
+	Denied     []string `json:"denied,omitempty"`
+	Reasons    []string `json:"reasons,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Team       string   `json:"team,omitempty"`
+	Channel    string   `json:"channel,omitempty"`
+}
+
+// newNotification builds the notification of a recorded config request
+func newNotification(e *AuditEvent, req *config.Request, host string) *Notification {
+	return &Notification{
+		Repo:       e.Repo,
+		Commit:     e.Commit,
+		Sender:     e.Sender,
+		Event:      e.Event,
+		Link:       fmt.Sprintf("%s/%s/%d", strings.TrimSuffix(host, "/"), req.Repo.Slug, req.Build.Number),
+		Decision:   e.Decision,
+		DecisionID: e.DecisionID,
+		Denied:     e.Denied,
+		Reasons:    e.Reasons,
+		Error:      e.Error,
+	}
+}
+
+// title summarises the notification in one line
+func (n *Notification) title() string {
+	switch n.Decision {
+	case auditDenied:
+		return fmt.Sprintf("Deploy denied for %s", n.Repo)
+	case auditFailOpen:
+		return fmt.Sprintf("Deploy of %s allowed without a permission check", n.Repo)
+	case auditMissing:
+		return fmt.Sprintf("Deploy blocked for %s, the repo has no usable .strithon.yml", n.Repo)
+	}
+	return fmt.Sprintf("Policy error for %s", n.Repo)
+}
+
+// teamsCard wraps the notification in an adaptive card message for a Teams
+// incoming webhook
+func (n *Notification) teamsCard() ([]byte, error) {
+	type fact struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	}
+	facts := []fact{
+		{"Repository", n.Repo},
+		{"Sender", n.Sender},
+		{"Commit", n.Commit},
+		{"Decision", n.Decision},
+	}
+	if n.DecisionID != "" {
+		facts = append(facts, fact{"Decision ID", n.DecisionID})
+	}
+	if len(n.Denied) > 0 {
+		facts = append(facts, fact{"Denied accounts", strings.Join(n.Denied, ", ")})
+	}
+	details := append([]string{}, n.Reasons...)
+	if n.Error != "" {
+		details = append(details, n.Error)
+	}
+	body := []interface{}{
+		map[string]interface{}{"type": "TextBlock", "size": "Medium", "weight": "Bolder", "text": n.title(), "wrap": true},
+		map[string]interface{}{"type": "FactSet", "facts": facts},
+	}
+	if len(details) > 0 {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": "- " + strings.Join(details, "\n- "), "wrap": true})
+	}
+	return json.Marshal(map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{map[string]interface{}{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.2",
+				"body":    body,
+				"actions": []interface{}{
+					map[string]interface{}{"type": "Action.OpenUrl", "title": "Open build", "url": n.Link},
+				},
+			},
+		}},
+	})
+}
+
+// Notifier posts notifications in the background, retrying failed
+// deliveries. A nil Notifier sends nothing.
+type Notifier struct {
+	settings NotifySettings
+	client   *http.Client
+	wg       sync.WaitGroup
+}
+
+// NewNotifier returns the Notifier of the notify settings, nil when no
+// webhook is set
+func (s *Settings) NewNotifier() *Notifier {
+	if len(s.Notify.Teams) == 0 && s.Notify.Webhook == "" {
+		return nil
+	}
+	timeout := s.Notify.Timeout
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &Notifier{settings: s.Notify, client: &http.Client{Timeout: timeout}}
+}
+
+// WithNotifier announces denials and policy errors with the Notifier
+func WithNotifier(n *Notifier) Option {
+	return func(p *Plugin) {
+		p.notifier = n
+	}
+}
+
+// Notify queues the notification for the Teams channel of the service and
+// the generic webhook, it does not wait for the deliveries
+func (n *Notifier) Notify(note *Notification) {
+	if n == nil || !contains(notifyDecisions, note.Decision) {
+		return
+	}
+	if url := n.settings.teamsWebhook(note.Team, note.Channel); url != "" {
+		body, err := note.teamsCard()
+		if err != nil {
+			logrus.Errorf("Unable to build the Teams notification: %v", err)
+		} else {
+			n.deliver(url, body)
+		}
+	}
+	if n.settings.Webhook != "" {
+		body, _ := json.Marshal(note)
+		n.deliver(n.settings.Webhook, body)
+	}
+}
+
+// Wait blocks until every queued delivery succeeded or ran out of retries,
+// or until ctx is done
+func (n *Notifier) Wait(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver posts the body in the background until it succeeds or the
+// retries run out
+func (n *Notifier) deliver(url string, body []byte) {
+	retries := n.settings.Retries
+	if retries == 0 {
+		retries = defaultNotifyRetries
+	}
+	backoff := n.settings.Backoff
+	if backoff == 0 {
+		backoff = defaultNotifyBackoff
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for attempt := 0; ; attempt++ {
+			err := n.post(url, body)
+			if err == nil {
+				return
+			}
+			if attempt == retries {
+				logrus.Errorf("Unable to send notification after %d attempts: %v", attempt+1, err)
+				return
+			}
+			logrus.Warnf("Unable to send notification, retrying: %v", err)
+			time.Sleep(backoff << uint(attempt))
+		}
+	}()
+}
+
+func (n *Notifier) post(url string, body []byte) error {
+	res, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Notification webhook returned %s", res.Status)
+	}
+	return nil
+}
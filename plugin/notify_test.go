@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookRecorder records the bodies posted to it, failing the first
+// requests
+type webhookRecorder struct {
+	mu     sync.Mutex
+	fail   int
+	calls  int
+	bodies [][]byte
+}
+
+func (w *webhookRecorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls++
+	if w.calls <= w.fail {
+		res.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	w.bodies = append(w.bodies, body)
+}
+
+func TestTeamsWebhook(t *testing.T) {
+	s := NotifySettings{Teams: map[string]string{
+		"BlackBird":           "https://teams/blackbird",
+		"BlackBird/custodian": "https://teams/custodian",
+	}}
+	assert.Equal(t, "https://teams/custodian", s.teamsWebhook("BlackBird", "custodian"))
+	assert.Equal(t, "https://teams/blackbird", s.teamsWebhook("BlackBird", "general"))
+	assert.Equal(t, "https://teams/blackbird", s.teamsWebhook("BlackBird", ""))
+	assert.Equal(t, "", s.teamsWebhook("Other", "custodian"))
+}
+
+func TestNotifierRetries(t *testing.T) {
+	rec := &webhookRecorder{fail: 2}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	settings := &Settings{Notify: NotifySettings{Webhook: ts.URL, Backoff: time.Millisecond}}
+	n := settings.NewNotifier()
+	n.Notify(&Notification{Repo: "org/name", Decision: auditDenied, Denied: []string{"222222222222"}})
+	// allowed deploys are not announced
+	n.Notify(&Notification{Repo: "org/name", Decision: auditAllowed})
+	n.Wait(noContext)
+
+	assert.Equal(t, 3, rec.calls)
+	if assert.Len(t, rec.bodies, 1) {
+		var note Notification
+		assert.NoError(t, json.Unmarshal(rec.bodies[0], &note))
+		assert.Equal(t, []string{"222222222222"}, note.Denied)
+	}
+
+	// deliveries give up once the retries run out
+	rec = &webhookRecorder{fail: 10}
+	ts2 := httptest.NewServer(rec)
+	defer ts2.Close()
+	settings.Notify = NotifySettings{Webhook: ts2.URL, Retries: 1, Backoff: time.Millisecond}
+	n = settings.NewNotifier()
+	n.Notify(&Notification{Repo: "org/name", Decision: auditError, Error: "auth api unavailable"})
+	n.Wait(noContext)
+	assert.Equal(t, 2, rec.calls)
+
+	assert.Nil(t, (&Settings{}).NewNotifier())
+
+	// waiting gives up with the context
+	rec = &webhookRecorder{fail: 10}
+	ts3 := httptest.NewServer(rec)
+	defer ts3.Close()
+	settings.Notify = NotifySettings{Webhook: ts3.URL, Retries: 5, Backoff: time.Minute}
+	n = settings.NewNotifier()
+	n.Notify(&Notification{Repo: "org/name", Decision: auditDenied})
+	ctx, cancel := context.WithTimeout(noContext, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, n.Wait(ctx))
+}
+
+func TestFindNotify(t *testing.T) {
+	rec := &webhookRecorder{}
+	teams := httptest.NewServer(rec)
+	defer teams.Close()
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", prodDenied)
+	defer ts.Close()
+
+	settings := &Settings{Notify: NotifySettings{Teams: map[string]string{"BlackBird/custodian": teams.URL}}}
+	n := settings.NewNotifier()
+	req := findRequest()
+	req.Build.Number = 42
+	p := newFindPlugin(ts, WithSettings(settings), WithNotifier(n))
+	if _, err := p.Find(noContext, req); !assert.NoError(t, err) {
+		return
+	}
+	n.Wait(noContext)
+	if !assert.Len(t, rec.bodies, 1) {
+		return
+	}
+	var card struct {
+		Type        string `json:"type"`
+		Attachments []struct {
+			ContentType string `json:"contentType"`
+			Content     struct {
+				Body []struct {
+					Text  string `json:"text"`
+					Facts []struct {
+						Title string `json:"title"`
+						Value string `json:"value"`
+					} `json:"facts"`
+				} `json:"body"`
+				Actions []struct {
+					URL string `json:"url"`
+				} `json:"actions"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}
+	if !assert.NoError(t, json.Unmarshal(rec.bodies[0], &card)) {
+		return
+	}
+	assert.Equal(t, "message", card.Type)
+	content := card.Attachments[0].Content
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", card.Attachments[0].ContentType)
+	assert.Equal(t, "Deploy denied for org/name", content.Body[0].Text)
+	assert.Contains(t, content.Body[1].Facts, struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	}{"Denied accounts", "222222222222"})
+	assert.Equal(t, ts.URL+"/org/name/42", content.Actions[0].URL)
+}
+
+func TestFindNotifyMissing(t *testing.T) {
+	rec := &webhookRecorder{}
+	hook := httptest.NewServer(rec)
+	defer hook.Close()
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "", "")
+	defer ts.Close()
+
+	// deploys blocked for a missing .strithon.yml are announced
+	settings := &Settings{
+		Require: RequireSettings{Namespaces: map[string]bool{"org": true}},
+		Notify:  NotifySettings{Webhook: hook.URL},
+	}
+	n := settings.NewNotifier()
+	p := newFindPlugin(ts, WithSettings(settings), WithNotifier(n))
+	if _, err := p.Find(noContext, findRequest()); !assert.NoError(t, err) {
+		return
+	}
+	n.Wait(noContext)
+	if assert.Len(t, rec.bodies, 1) {
+		var note Notification
+		assert.NoError(t, json.Unmarshal(rec.bodies[0], &note))
+		assert.Equal(t, auditMissing, note.Decision)
+		assert.Equal(t, "Deploy blocked for org/name, the repo has no usable .strithon.yml", note.title())
+	}
+}
+
+func TestNotifyWaitTimeout(t *testing.T) {
+	assert.Equal(t, defaultNotifyWait, (&NotifySettings{}).WaitTimeout())
+	assert.Equal(t, time.Second, (&NotifySettings{Wait: time.Second}).WaitTimeout())
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ouPathSeparator joins the OUs an account was found through
+const ouPathSeparator = " > "
+
+// OrganizationUnit is an AWS Organizations OU of the offline map
+type OrganizationUnit struct {
+	Name     string   `yaml:"name"`
+	Accounts []string `yaml:"accounts"`
+	// Children are the ids of nested OUs, their accounts belong to this OU
+	// too
+	Children []string `yaml:"children"`
+}
+
+// OrganizationSettings is the offline AWS Organizations map used to resolve
+// the ou of an environment. Units are keyed by OU id and may be given
+// inline, in a file, or both.
+type OrganizationSettings struct {
+	File  string                      `yaml:"file"`
+	Units map[string]OrganizationUnit `yaml:"units"`
+}
+
+// load adds the units of the organizations file
+func (o *OrganizationSettings) load() error {
+	if o.File == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(o.File)
+	if err != nil {
+		return err
+	}
+	var file OrganizationSettings
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("Error parsing organizations file %s: %v", o.File, err)
+	}
+	if o.Units == nil {
+		o.Units = map[string]OrganizationUnit{}
+	}
+	for id, unit := range file.Units {
+		if _, ok := o.Units[id]; !ok {
+			o.Units[id] = unit
+		}
+	}
+	return nil
+}
+
+// lookup finds an OU by id or name
+func (o *OrganizationSettings) lookup(ref string) (string, OrganizationUnit, bool) {
+	if unit, ok := o.Units[ref]; ok {
+		return ref, unit, true
+	}
+	for id, unit := range o.Units {
+		if unit.Name == ref {
+			return id, unit, true
+		}
+	}
+	return "", OrganizationUnit{}, false
+}
+
+// resolvedAccount is an account of an environment and, when it came from an
+// ou, the OUs it was found through
+type resolvedAccount struct {
+	Account string
+	OU      string
+}
+
+// resolveOU returns the accounts of an OU and its children, each with the
+// path of OUs it was found through
+func (o *OrganizationSettings) resolveOU(ref string) ([]resolvedAccount, error) {
+	accounts := []resolvedAccount{}
+	err := o.walk(ref, nil, map[string]bool{}, &accounts)
+	return accounts, err
+}
+
+func (o *OrganizationSettings) walk(ref string, path []string, seen map[string]bool, accounts *[]resolvedAccount) error {
+	id, unit, ok := o.lookup(ref)
+	if !ok {
+		return fmt.Errorf("ou %s is not in the organizations map", ref)
+	}
+	if seen[id] {
+		return nil
+	}
+	seen[id] = true
+	name := unit.Name
+	if name == "" {
+		name = id
+	}
+	path = append(path, name)
+	for _, acct := range unit.Accounts {
+		*accounts = append(*accounts, resolvedAccount{Account: acct, OU: strings.Join(path, ouPathSeparator)})
+	}
+	for _, child := range unit.Children {
+		if err := o.walk(child, path, seen, accounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// environmentAccounts returns every account an environment deploys to:
+// account, then accounts, then the accounts of its ou, without duplicates
+func (o *OrganizationSettings) environmentAccounts(env Environment) ([]resolvedAccount, error) {
+	if env.Cloud != "" && env.Cloud != cloudAWS {
+		return []resolvedAccount{{Account: env.Target()}}, nil
+	}
+	accounts := []resolvedAccount{}
+	if env.Account != "" {
+		accounts = append(accounts, resolvedAccount{Account: string(env.Account)})
+	}
+	for _, acct := range env.Accounts {
+		accounts = append(accounts, resolvedAccount{Account: string(acct)})
+	}
+	if env.OU != "" {
+		ou, err := o.resolveOU(env.OU)
+		if err != nil {
+			return nil, fmt.Errorf("environment %s: %v", env.Name, err)
+		}
+		accounts = append(accounts, ou...)
+	}
+	seen := map[string]bool{}
+	unique := []resolvedAccount{}
+	for _, acct := range accounts {
+		if seen[acct.Account] {
+			continue
+		}
+		seen[acct.Account] = true
+		unique = append(unique, acct)
+	}
+	return unique, nil
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironmentAccounts(t *testing.T) {
+	orgs := &OrganizationSettings{File: "testdata/organizations.yml"}
+	if !assert.NoError(t, orgs.load()) {
+		return
+	}
+
+	accounts, err := orgs.environmentAccounts(Environment{
+		Name:     "prod",
+		Cloud:    cloudAWS,
+		Account:  "333333333333",
+		Accounts: []AccountNumber{"111111111111"},
+		OU:       "ou-ab12-payments",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []resolvedAccount{
+		{Account: "333333333333"},
+		{Account: "111111111111"},
+		{Account: "444444444444", OU: "payments > cells"},
+		{Account: "555555555555", OU: "payments > cells"},
+	}, accounts)
+
+	// OUs are found by name too
+	accounts, err = orgs.environmentAccounts(Environment{Name: "prod", OU: "cells"})
+	assert.NoError(t, err)
+	assert.Len(t, accounts, 2)
+
+	_, err = orgs.environmentAccounts(Environment{Name: "prod", Cloud: cloudAWS, OU: "ou-missing"})
+	assert.EqualError(t, err, "environment prod: ou ou-missing is not in the organizations map")
+
+	// other clouds have a single account
+	accounts, err = orgs.environmentAccounts(Environment{Cloud: cloudGCP, Project: "strithon-prod-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []resolvedAccount{{Account: "strithon-prod-1"}}, accounts)
+}
+
+func TestLoadSettingsOrganizations(t *testing.T) {
+	f, _ := ioutil.TempFile("", "settings")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+organizations:
+  file: testdata/organizations.yml
+  units:
+    ou-ab12-cells:
+      name: cells
+      accounts: ["777777777777"]
+`)
+	f.Close()
+	settings, err := LoadSettings(f.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	// inline units win over the file
+	assert.Equal(t, []string{"777777777777"}, settings.Organizations.Units["ou-ab12-cells"].Accounts)
+	assert.Contains(t, settings.Organizations.Units, "ou-ab12-payments")
+}
+
+func TestValidateOrganizations(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone.yml", "testdata/.strithon-ou.yml", `{"decision_id":"d1","result":{"allow":false,"denials":[{"account":"555555555555","environment":"prod","reason":"cell is frozen"}]}}`)
+	defer ts.Close()
+
+	orgs := OrganizationSettings{File: "testdata/organizations.yml"}
+	orgs.load()
+	a := &recordingAuthorizer{}
+	p := newFindPlugin(ts, WithSettings(&Settings{Organizations: orgs}), WithAuthorizer(a))
+	_, err := p.Validate(noContext, findRequest(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"111111111111", "666666666666", "333333333333", "444444444444", "555555555555"}, a.in.Input.Accounts)
+	assert.Equal(t, AuthEnvironment{Name: "prod", Account: "444444444444", Cloud: cloudAWS, Region: "us-east-1", OU: "payments > cells"}, a.in.Input.Environments[3])
+
+	// the denial shows the OU the account came from
+	p = newFindPlugin(ts, WithSettings(&Settings{Organizations: orgs}))
+	d, err := p.Validate(noContext, findRequest(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"qa", "prod"}, d.Environments)
+	assert.Equal(t, []string{"account 555555555555 (environment prod) from OU payments > cells: cell is frozen"}, d.Reasons())
+
+	// an unknown OU is reported like any other problem in .strithon.yml
+	p = newFindPlugin(ts, WithAuthorizer(a))
+	_, err = p.Validate(noContext, findRequest(), "")
+	assert.IsType(t, ValidationErrors{}, err)
+	assert.EqualError(t, err, "environment prod: ou payments is not in the organizations map")
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// outageClosed replaces the deploy steps with a denial step
+	outageClosed = "closed"
+
+	// outageOpen allows the deploy with a warning step and an audit record
+	outageOpen = "open"
+
+	// outageFail fails the config request so the build errors
+	outageFail = "fail"
+
+	// outageReason is the denial reason given when failing closed
+	outageReason = "the authorization service is unavailable"
+
+	// outageStepName is the name of the warning step added when failing open
+	outageStepName = "authorization-unavailable-warning"
+)
+
+// ErrAuthUnavailable is returned when the authorization service could not
+// give an answer
+var ErrAuthUnavailable = errors.New("authorization service unavailable")
+
+// OutageSettings says what an authorization outage means for each environment
+type OutageSettings struct {
+	// Default applies to environments not listed, closed unless set
+	Default string `yaml:"default"`
+	// Environments maps an environment name to closed, open or fail
+	Environments map[string]string `yaml:"environments"`
+	// Timeout bounds each call to the auth api
+	Timeout time.Duration `yaml:"timeout"`
+	// Failures is the number of consecutive failures that opens the breaker
+	Failures int `yaml:"failures"`
+	// Cooldown is how long the breaker stays open before trying again
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Validate checks every outage mode is closed, open or fail
+func (o *OutageSettings) Validate() error {
+	modes := []string{o.Default}
+	for _, mode := range o.Environments {
+		modes = append(modes, mode)
+	}
+	for _, mode := range modes {
+		if mode != "" && mode != outageClosed && mode != outageOpen && mode != outageFail {
+			return fmt.Errorf("Unknown outage mode %s", mode)
+		}
+	}
+	return nil
+}
+
+// Mode returns the outage behaviour for an environment
+func (o *OutageSettings) Mode(env string) string {
+	if mode, ok := o.Environments[env]; ok {
+		return mode
+	}
+	if o.Default != "" {
+		return o.Default
+	}
+	return outageClosed
+}
+
+// applyOutage turns an unanswered policy request into a decision following
+// the outage settings. It returns an error for environments set to fail.
+func applyOutage(in *AuthRequest, o *OutageSettings, cause error) (*Decision, error) {
+	decision := &Decision{Allowed: true, Outage: true, Requested: in.Input.Accounts}
+	decision.Environments = in.Input.environmentNames()
+	for _, env := range in.Input.Environments {
+		switch o.Mode(env.Name) {
+		case outageOpen:
+			if !contains(decision.FailOpen, env.Name) {
+				decision.FailOpen = append(decision.FailOpen, env.Name)
+			}
+		case outageFail:
+			return nil, fmt.Errorf("Environment %s cannot be checked: %v", env.Name, cause)
+		default:
+			decision.Allowed = false
+			decision.Denials = append(decision.Denials, Denial{
+				Account:     env.Account,
+				Environment: env.Name,
+				Reason:      outageReason,
+			})
+		}
+	}
+	return decision, nil
+}
+
+// injectOutageWarning adds a non-blocking step to the pipeline telling the
+// developer the deploy was allowed without a permission check
+func injectOutageWarning(pipe *yaml.Pipeline, decision *Decision) {
+	pipe.Steps = append([]*yaml.Container{{
+		Name:    uniqueStepName(pipe, outageStepName),
+		Image:   "alpine",
+		Failure: "ignore",
+		Commands: []string{
+			fmt.Sprintf("echo 'WARNING: the authorization service is unavailable, deploys to %s were allowed without a permission check and have been recorded.'", strings.Join(decision.FailOpen, ", ")),
+		},
+	}}, pipe.Steps...)
+}
+
+// circuitBreaker stops calling an Authorizer that keeps failing so a dead
+// auth api doesn't add its timeout to every build
+type circuitBreaker struct {
+	next     Authorizer
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	count    int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker wraps an Authorizer, opening after the given number of
+// consecutive failures and trying again once the cooldown has passed
+func NewCircuitBreaker(next Authorizer, failures int, cooldown time.Duration) Authorizer {
+	return &circuitBreaker{
+		next:     next,
+		failures: failures,
+		cooldown: cooldown,
+	}
+}
+
+// Authorize calls the wrapped Authorizer unless the breaker is open
+func (c *circuitBreaker) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	c.mu.Lock()
+	if c.count >= c.failures && time.Since(c.openedAt) < c.cooldown {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: circuit breaker is open", ErrAuthUnavailable)
+	}
+	c.mu.Unlock()
+
+	res, err := c.next.Authorize(ctx, in, token)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.count++
+		if c.count >= c.failures {
+			logger(ctx).Warnf("Auth api failed %d times in a row, pausing calls for %s", c.count, c.cooldown)
+			c.openedAt = time.Now()
+		}
+		return nil, err
+	}
+	c.count = 0
+	return res, nil
+}
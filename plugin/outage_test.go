@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// countingAuthorizer fails every call and counts them
+type countingAuthorizer struct {
+	calls int
+}
+
+func (c *countingAuthorizer) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	c.calls++
+	return nil, ErrAuthUnavailable
+}
+
+func TestOutageMode(t *testing.T) {
+	o := OutageSettings{Environments: map[string]string{"qa": "open"}}
+	assert.Equal(t, "open", o.Mode("qa"))
+	assert.Equal(t, "closed", o.Mode("prod"))
+
+	o.Default = "fail"
+	assert.Equal(t, "fail", o.Mode("prod"))
+}
+
+func TestOutageValidate(t *testing.T) {
+	o := OutageSettings{Default: "open", Environments: map[string]string{"qa": "fail", "prod": "closed"}}
+	assert.NoError(t, o.Validate())
+
+	o.Environments["qa"] = "opne"
+	assert.EqualError(t, o.Validate(), "Unknown outage mode opne")
+
+	_, err := ParseSettings([]byte("outage:\n  default: opne\n"))
+	assert.Error(t, err)
+}
+
+func TestApplyOutage(t *testing.T) {
+	in := &AuthRequest{}
+	in.Input.Environments = []AuthEnvironment{
+		{Name: "qa", Account: "111111111111"},
+		{Name: "prod", Account: "222222222222"},
+	}
+
+	decision, err := applyOutage(in, &OutageSettings{Environments: map[string]string{"qa": "open"}}, ErrAuthUnavailable)
+	if assert.NoError(t, err) {
+		assert.False(t, decision.Allowed)
+		assert.True(t, decision.Outage)
+		assert.Equal(t, []string{"qa"}, decision.FailOpen)
+		assert.Equal(t, []string{"222222222222"}, decision.Accounts())
+	}
+
+	decision, err = applyOutage(in, &OutageSettings{Default: "open"}, ErrAuthUnavailable)
+	if assert.NoError(t, err) {
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, []string{"qa", "prod"}, decision.FailOpen)
+	}
+
+	_, err = applyOutage(in, &OutageSettings{Environments: map[string]string{"prod": "fail"}}, ErrAuthUnavailable)
+	assert.Error(t, err)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	next := &countingAuthorizer{}
+	breaker := NewCircuitBreaker(next, 2, 50*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err := breaker.Authorize(noContext, &AuthRequest{}, "")
+		assert.True(t, errors.Is(err, ErrAuthUnavailable))
+	}
+	assert.Equal(t, 2, next.calls, "breaker should stop calling after two failures")
+
+	time.Sleep(60 * time.Millisecond)
+	breaker.Authorize(noContext, &AuthRequest{}, "")
+	assert.Equal(t, 3, next.calls, "breaker should try again after the cooldown")
+}
+
+func TestInjectOutageWarning(t *testing.T) {
+	content, _ := ioutil.ReadFile("testdata/.drone-environments.yml")
+	manifest, _ := yaml.Parse(strings.NewReader(string(content)))
+	pipe := manifest.Resources[0].(*yaml.Pipeline)
+	injectOutageWarning(pipe, &Decision{FailOpen: []string{"qa"}})
+	assert.Equal(t, outageStepName, pipe.Steps[0].Name)
+	assert.Equal(t, "ignore", pipe.Steps[0].Failure)
+	assert.Contains(t, pipe.Steps[0].Commands[0], "deploys to qa were allowed")
+
+	// a second warning doesn't reuse the name
+	injectOutageWarning(pipe, &Decision{FailOpen: []string{"qa"}})
+	assert.Equal(t, outageStepName+"-2", pipe.Steps[0].Name)
+}
+
+func TestValidateOutage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.EscapedPath(), "/v1") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		out, _ := ioutil.ReadFile("testdata/contents-multi-env.json")
+		w.Write(out)
+	}))
+	defer ts.Close()
+
+	trans := oauth2.NewClient(noContext, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: mockToken},
+	))
+	client, _ := github.NewEnterpriseClient(ts.URL, ts.URL, trans)
+	req := &config.Request{
+		Repo: drone.Repo{Namespace: "multi-env", Name: "name"},
+	}
+
+	settings := &Settings{Outage: OutageSettings{Environments: map[string]string{"qa": "open"}}}
+	p := New(ts.URL, mockToken, "", ts.URL, ts.URL, ts.URL, "", "", nil, client, WithSettings(settings))
+	decision, err := p.Validate(noContext, req, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"qa"}, decision.FailOpen)
+		assert.Equal(t, []string{"222222222222"}, decision.Accounts())
+	}
+
+	settings.Outage.Default = "fail"
+	_, err = p.Validate(noContext, req, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,301 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/google/go-github/github"
+)
+
+// defaultTeamCacheTTL is how long team lookups are kept when no ttl is set
+const defaultTeamCacheTTL = 5 * time.Minute
+
+// OwnershipSettings lists the environments only the owners of a service
+// may deploy to
+type OwnershipSettings struct {
+	// Protected are glob patterns of environment names
+	Protected []string `yaml:"protected"`
+	// CacheTTL is how long team lookups are cached
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// protected returns true when the environment is protected
+func (o *OwnershipSettings) protected(env string) bool {
+	for _, pattern := range o.Protected {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(env)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// TeamMembership tells whether a user belongs to a team of an org
+type TeamMembership interface {
+	IsMember(ctx context.Context, org, team, user string) (bool, error)
+}
+
+// WithTeamMembership replaces the GitHub team lookups
+func WithTeamMembership(t TeamMembership) Option {
+	return func(p *Plugin) {
+		p.teams = t
+	}
+}
+
+// NewTeamMembership returns GitHub team lookups cached for the ownership
+// cache ttl
+func (s *Settings) NewTeamMembership(client *github.Client) TeamMembership {
+	ttl := s.Ownership.CacheTTL
+	if ttl == 0 {
+		ttl = defaultTeamCacheTTL
+	}
+	return &githubTeams{
+		client:  client,
+		ttl:     ttl,
+		teams:   map[string]teamEntry{},
+		members: map[string]memberEntry{},
+	}
+}
+
+// githubTeams looks teams and memberships up with the GitHub api. Answers
+// are cached, errors are not.
+type githubTeams struct {
+	client *github.Client
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	teams   map[string]teamEntry
+	members map[string]memberEntry
+}
+
+type teamEntry struct {
+	id      int64
+	found   bool
+	expires time.Time
+}
+
+type memberEntry struct {
+	member  bool
+	expires time.Time
+}
+
+// IsMember returns true when the user is an active member of the team,
+// found by slug or name
+func (g *githubTeams) IsMember(ctx context.Context, org, team, user string) (bool, error) {
+	key := strings.ToLower(org + "/" + team + "/" + user)
+	g.mu.Lock()
+	entry, ok := g.members[key]
+	g.mu.Unlock()
+	hit := ok && time.Now().Before(entry.expires)
+	CountCache("team_membership", hit)
+	if hit {
+		return entry.member, nil
+	}
+
+	id, found, err := g.teamID(ctx, org, team)
+	if err != nil {
+		return false, err
+	}
+	member := false
+	if found {
+		membership, _, err := g.client.Teams.GetTeamMembership(ctx, id, user)
+		if err != nil && !isNotFound(err) {
+			return false, err
+		}
+		member = err == nil && membership.GetState() == "active"
+	}
+	g.mu.Lock()
+	g.members[key] = memberEntry{member: member, expires: time.Now().Add(g.ttl)}
+	g.mu.Unlock()
+	return member, nil
+}
+
+// teamID finds the id of a team of the org by slug or name
+func (g *githubTeams) teamID(ctx context.Context, org, team string) (int64, bool, error) {
+	key := strings.ToLower(org + "/" + team)
+	g.mu.Lock()
+	entry, ok := g.teams[key]
+	g.mu.Unlock()
+	hit := ok && time.Now().Before(entry.expires)
+	CountCache("team", hit)
+	if hit {
+		return entry.id, entry.found, nil
+	}
+
+	entry = teamEntry{expires: time.Now().Add(g.ttl)}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		teams, res, err := g.client.Teams.ListTeams(ctx, org, opts)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, t := range teams {
+			if strings.EqualFold(t.GetSlug(), team) || strings.EqualFold(t.GetName(), team) {
+				entry.id, entry.found = t.GetID(), true
+			}
+		}
+		if entry.found || res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+	g.mu.Lock()
+	g.teams[key] = entry
+	g.mu.Unlock()
+	return entry.id, entry.found, nil
+}
+
+// checkOwnership denies the protected environments of the request when the
+// sender is neither an owner of the service nor a member of its team. An
+// environment is protected by its name in the build or by the name its
+// account has on the default branch.
+func (p *Plugin) checkOwnership(ctx context.Context, req *config.Request, in *AuthRequest, decision *Decision, trusted *trust) {
+	if trusted == nil {
+		return
+	}
+	protected := []AuthEnvironment{}
+	for _, env := range in.Input.Environments {
+		for _, name := range trusted.environmentNames(env) {
+			if p.settings.Ownership.protected(name) {
+				protected = append(protected, env)
+				break
+			}
+		}
+	}
+	if len(protected) == 0 {
+		return
+	}
+	sender := req.Build.Sender
+	service, reason := trusted.service, trusted.reason
+	owner := false
+	if service != nil {
+		owner, reason = p.isOwner(ctx, req.Repo.Namespace, sender, service)
+	}
+	if owner {
+		return
+	}
+	logger(ctx).WithField("sender", sender).Warnf("Protected environments denied: %s", reason)
+	for _, env := range protected {
+		decision.Denials = append(decision.Denials, Denial{
+			Account:     env.Account,
+			Environment: env.Name,
+			Reason:      reason,
+			OU:          env.OU,
+		})
+	}
+	decision.Allowed = false
+}
+
+// ownershipRef returns the ref the owners of a service are read from: the
+// default branch, or the commit before a push to it, so the commit being
+// built cannot name its own owners
+func ownershipRef(req *config.Request) string {
+	build := req.Build
+	if build.Event == drone.EventPush && build.Target == req.Repo.Branch && strings.Trim(build.Before, "0") != "" {
+		return build.Before
+	}
+	return req.Repo.Branch
+}
+
+// trustedService returns the service of the .strithon.yml the owners are
+// read from, or the reason it has none
+func (p *Plugin) trustedService(ctx context.Context, req *config.Request) (*bellyjay1005, string) {
+	ref := ownershipRef(req)
+	content, err := p.getGithubFile(ctx, req, req.Repo.Namespace, req.Repo.Name, ".strithon.yml", ref)
+	if isNotFound(err) || (err == nil && content == "") {
+		return nil, "the default branch has no .strithon.yml naming the owners of the service"
+	}
+	if err != nil {
+		logger(ctx).Errorf("Error reading the owners of %s at %q: %s", req.Repo.Slug, ref, err)
+		return nil, "the owners of the service could not be read from the default branch"
+	}
+	f, err := ParsestrithonFile(content, WithAccountRegistry(&p.settings.Registry))
+	if err != nil {
+		logger(ctx).Warnf("Invalid .strithon.yml in %s at %q: %s", req.Repo.Slug, ref, err)
+		return nil, "the .strithon.yml on the default branch is invalid"
+	}
+	return f.Service(), ""
+}
+
+// trust is what the .strithon.yml the owners are read from says about a
+// service, so a build cannot rename its environments out of protection
+type trust struct {
+	service *bellyjay1005
+	// reason is why there is no service
+	reason string
+	// names maps accounts to the environments deploying to them
+	names map[string][]string
+}
+
+// loadTrust reads the service and the environment names of its accounts
+// from the default branch
+func (p *Plugin) loadTrust(ctx context.Context, req *config.Request) *trust {
+	service, reason := p.trustedService(ctx, req)
+	t := &trust{service: service, reason: reason, names: map[string][]string{}}
+	if service == nil {
+		return t
+	}
+	for _, env := range service.Metadata.Environments {
+		accounts, err := p.settings.Organizations.environmentAccounts(env)
+		if err != nil {
+			logger(ctx).Warnf("Error resolving the accounts of environment %s on the default branch: %s", env.Name, err)
+			continue
+		}
+		for _, acct := range accounts {
+			if !contains(t.names[acct.Account], env.Name) {
+				t.names[acct.Account] = append(t.names[acct.Account], env.Name)
+			}
+		}
+	}
+	return t
+}
+
+// environmentNames returns the name of an environment in the build and the
+// names its account has on the default branch
+func (t *trust) environmentNames(env AuthEnvironment) []string {
+	return append([]string{env.Name}, t.names[env.Account]...)
+}
+
+// verifiedTeam returns the team named in .strithon.yml when the sender is an
+// active member of it, and "" otherwise, so a repo cannot claim another
+// team's policy rules
+func (p *Plugin) verifiedTeam(ctx context.Context, org, sender, team string) string {
+	if team == "" || p.teams == nil {
+		return ""
+	}
+	member, err := p.teams.IsMember(ctx, org, team, sender)
+	if err != nil {
+		logger(ctx).Errorf("Error looking up team %s/%s: %s", org, team, err)
+		return ""
+	}
+	if !member {
+		logger(ctx).WithField("sender", sender).Warnf("Team %s ignored, the sender is not a member", team)
+		return ""
+	}
+	return team
+}
+
+// isOwner returns true when the sender may deploy the service to protected
+// environments, or the reason they may not
+func (p *Plugin) isOwner(ctx context.Context, org, sender string, service *bellyjay1005) (bool, string) {
+	for _, owner := range service.Metadata.Service.Owners {
+		if strings.EqualFold(owner, sender) {
+			return true, ""
+		}
+	}
+	team := service.Metadata.Service.Team
+	member, err := p.teams.IsMember(ctx, org, team, sender)
+	if err != nil {
+		logger(ctx).Errorf("Error looking up team %s/%s: %s", org, team, err)
+		return false, fmt.Sprintf("the membership of %s in team %s could not be checked", sender, team)
+	}
+	if member {
+		return true, ""
+	}
+	return false, fmt.Sprintf("%s is not an owner of the service nor a member of team %s", sender, team)
+}
@@ -0,0 +1,233 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// fakeTeams answers team lookups from a fixed list of members
+type fakeTeams struct {
+	members []string
+	err     error
+	calls   int
+}
+
+func (f *fakeTeams) IsMember(ctx context.Context, org, team, user string) (bool, error) {
+	f.calls++
+	return contains(f.members, org+"/"+team+"/"+user), f.err
+}
+
+func TestGithubTeams(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.EscapedPath() {
+		case "/orgs/org/teams":
+			w.Write([]byte(`[{"id": 7, "slug": "sarahconnor", "name": "Sarah Connor"}]`))
+		case "/teams/7/memberships/octocat":
+			w.Write([]byte(`{"state": "active"}`))
+		case "/teams/7/memberships/pending":
+			w.Write([]byte(`{"state": "pending"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	trans := oauth2.NewClient(noContext, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: mockToken},
+	))
+	client, _ := github.NewEnterpriseClient(ts.URL, ts.URL, trans)
+	teams := (&Settings{}).NewTeamMembership(client)
+
+	cases := []struct {
+		team, user string
+		member     bool
+	}{
+		{"sarahconnor", "octocat", true},
+		{"Sarah Connor", "octocat", true},
+		{"sarahconnor", "pending", false},
+		{"sarahconnor", "hubot", false},
+		{"missing", "octocat", false},
+	}
+	for _, c := range cases {
+		member, err := teams.IsMember(noContext, "org", c.team, c.user)
+		assert.NoError(t, err, c.team+"/"+c.user)
+		assert.Equal(t, c.member, member, c.team+"/"+c.user)
+	}
+
+	// answers are cached
+	seen := requests
+	member, _ := teams.IsMember(noContext, "org", "sarahconnor", "octocat")
+	assert.True(t, member)
+	assert.Equal(t, seen, requests)
+
+	_, err := teams.IsMember(noContext, "other", "sarahconnor", "octocat")
+	assert.Error(t, err)
+}
+
+func TestFindOwnership(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Ownership: OwnershipSettings{Protected: []string{"prod*"}}}
+	teams := &fakeTeams{}
+	p := newFindPlugin(ts, WithSettings(settings), WithTeamMembership(teams))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	// only the protected environment is replaced
+	assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+	assert.Contains(t, res.Data, "octocat is not an owner of the service nor a member of team sarahconnor")
+	assert.NotContains(t, res.Data, "deploy-qa-unauthorized")
+
+	teams.members = []string{"org/sarahconnor/octocat"}
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.NotContains(t, res.Data, "unauthorized")
+	}
+
+	// owners are allowed without a team lookup, the one made checks the
+	// team of the policy input
+	teams.members, teams.calls = nil, 0
+	req := findRequest()
+	req.Build.Sender = "admin@strithon.com"
+	res, err = p.Find(noContext, req)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, res.Data, "unauthorized")
+		assert.Equal(t, 1, teams.calls)
+	}
+
+	// a failed lookup denies
+	teams.err = errors.New("github is down")
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "the membership of octocat in team sarahconnor could not be checked")
+	}
+
+	// nothing is looked up without protected environments
+	settings.Ownership.Protected = nil
+	teams.calls = 0
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.False(t, strings.Contains(res.Data, "unauthorized"))
+		assert.Equal(t, 1, teams.calls)
+	}
+}
+
+func TestValidateVerifiedTeam(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", "")
+	defer ts.Close()
+
+	a := &recordingAuthorizer{}
+	teams := &fakeTeams{}
+	p := newFindPlugin(ts, WithAuthorizer(a), WithTeamMembership(teams))
+
+	// a team the sender doesn't belong to is not passed to the policy
+	_, err := p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) && assert.NotNil(t, a.in) {
+		assert.Equal(t, "", a.in.Input.Team)
+	}
+
+	teams.members = []string{"org/sarahconnor/octocat"}
+	_, err = p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sarahconnor", a.in.Input.Team)
+	}
+
+	// a failed lookup drops the team
+	teams.err = errors.New("github is down")
+	_, err = p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", a.in.Input.Team)
+	}
+}
+
+func TestFindOwnershipFromDefaultBranch(t *testing.T) {
+	// the built commit adds the sender to the owners and points team at a
+	// team the sender belongs to
+	const after = "a1afc9b699274831f841d1fd8ace0f5e91d92711"
+	ts := newFindServerRefs(t, "testdata/.drone-environments.yml", map[string]string{
+		"":     "testdata/.strithon-multi-env.yml",
+		after:  "testdata/.strithon-self-owner.yml",
+		"main": "testdata/.strithon-multi-env.yml",
+	}, `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Ownership: OwnershipSettings{Protected: []string{"prod*"}}}
+	teams := &fakeTeams{members: []string{"org/octocats/octocat"}}
+	p := newFindPlugin(ts, WithSettings(settings), WithTeamMembership(teams))
+
+	// a pull request into the default branch
+	req := findRequest()
+	req.Repo.Branch = "main"
+	req.Build.Event = drone.EventPullRequest
+	req.Build.Source, req.Build.Target = "feature/x", "main"
+	res, err := p.Find(noContext, req)
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+		assert.Contains(t, res.Data, "octocat is not an owner of the service nor a member of team sarahconnor")
+	}
+
+	// a push to the default branch is checked against the commit before it
+	req = findRequest()
+	req.Repo.Branch = "main"
+	req.Build.Target = "main"
+	req.Build.Before = "9d2f1e0c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e"
+	res, err = p.Find(noContext, req)
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+	}
+	assert.Equal(t, "9d2f1e0c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e", ownershipRef(req))
+
+	// the first push of a branch has no commit before it
+	req.Build.Before = "0000000000000000000000000000000000000000"
+	assert.Equal(t, "main", ownershipRef(req))
+}
+
+func TestFindOwnershipWithoutDefaultBranchFile(t *testing.T) {
+	const after = "a1afc9b699274831f841d1fd8ace0f5e91d92711"
+	ts := newFindServerRefs(t, "testdata/.drone-environments.yml", map[string]string{
+		after: "testdata/.strithon-self-owner.yml",
+	}, `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Ownership: OwnershipSettings{Protected: []string{"prod*"}}}
+	p := newFindPlugin(ts, WithSettings(settings), WithTeamMembership(&fakeTeams{}))
+	req := findRequest()
+	req.Repo.Branch = "main"
+	res, err := p.Find(noContext, req)
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+		assert.Contains(t, res.Data, "the default branch has no .strithon.yml naming the owners of the service")
+	}
+}
+
+func TestValidateOwnershipRenamedEnvironment(t *testing.T) {
+	// the built commit renames prod but keeps its account
+	const after = "a1afc9b699274831f841d1fd8ace0f5e91d92711"
+	ts := newFindServerRefs(t, "testdata/.drone-environments.yml", map[string]string{
+		"":    "testdata/.strithon-multi-env.yml",
+		after: "testdata/.strithon-renamed.yml",
+	}, `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Ownership: OwnershipSettings{Protected: []string{"prod*"}}}
+	p := newFindPlugin(ts, WithSettings(settings), WithTeamMembership(&fakeTeams{}))
+	req := findRequest()
+	req.Repo.Branch = "main"
+	d, err := p.Validate(noContext, req, "")
+	if assert.NoError(t, err) {
+		assert.False(t, d.Allowed)
+		assert.Equal(t, []string{"account 222222222222 (environment prd): octocat is not an owner of the service nor a member of team sarahconnor"}, d.Reasons())
+	}
+}
@@ -1,36 +1,75 @@
 package plugin
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
 	"strconv"
+	"strings"
 
-	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
-// AccountNumber is a special struct that acts as a conditional string/int type
+const (
+	// kindService describes the service and the environments it deploys to
+	kindService = "service"
+
+	// kindCloudFormation describes a stack deployed to the environments
+	kindCloudFormation = "aws-cloudformation"
+
+	// cloudAWS environments deploy to an AWS account and region
+	cloudAWS = "aws"
+
+	// cloudGCP environments deploy to a Google Cloud project
+	cloudGCP = "gcp"
+
+	// cloudAzure environments deploy to an Azure subscription of a tenant
+	cloudAzure = "azure"
+
+	// statePresent deploys the stack, it is the default state
+	statePresent = "present"
+
+	// stateDelete deletes the stack
+	stateDelete = "delete"
+)
+
+var (
+	// knownKinds are the document kinds a .strithon.yml may hold
+	knownKinds = []string{kindService, kindCloudFormation}
+
+	// knownClouds are the values allowed for an environment's cloud
+	knownClouds = []string{cloudAWS, cloudGCP, cloudAzure}
+
+	// knownStates are the values allowed for a stack's state
+	knownStates = []string{statePresent, stateDelete}
+
+	awsAccountPattern   = regexp.MustCompile(`^[0-9]{12}$`)
+	awsRegionPattern    = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-(north|south|east|west|central|northeast|northwest|southeast|southwest)-[0-9]$`)
+	gcpProjectPattern   = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	gcpRegionPattern    = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]$`)
+	azureIDPattern      = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	azureRegionPattern  = regexp.MustCompile(`^[a-z]+[a-z0-9]*$`)
+	accountAliasPattern = regexp.MustCompile(`^[a-z][a-z0-9-]*[a-z0-9]$`)
+	errorLinePattern    = regexp.MustCompile(`line ([0-9]+)`)
+)
+
+// AccountNumber is an account id written as a string or a number. It keeps
+// the id exactly as written so leading zeros survive.
 type AccountNumber string
 
 // UnmarshalYAML handles the unmarshalling of the AccountNumber type
-func (n *AccountNumber) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	var str string
-	if err := unmarshal(&str); err == nil {
-		anum := AccountNumber(str)
-		*n = anum
-		return nil
-	}
-	var num int
-	if err := unmarshal(&num); err != nil {
-		logrus.Errorf("There's an error: %s", err)
-		return err
+func (n *AccountNumber) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: account must be a string or a number", value.Line)
 	}
-	anum := AccountNumber(strconv.Itoa(num))
-	*n = anum
+	*n = AccountNumber(value.Value)
 	return nil
 }
 
 // bellyjay1005 is the struct for .strithon.yml files
 type bellyjay1005 struct {
-	Kind     string
+	Kind     string `yaml:"kind"`
 	Metadata struct {
 		Service struct {
 			ID     string   `yaml:"id"`
@@ -44,23 +83,629 @@ type bellyjay1005 struct {
 			} `yaml:"ms_team"`
 			Description string `yaml:"description"`
 		} `yaml:"service"`
-		Environments []struct {
-			Name    string        `yaml:"name"`
-			Cloud   string        `yaml:"cloud"`
-			Account AccountNumber `yaml:"account"`
-			Region  string        `yaml:"region"`
-		} `yaml:"environments",omitempty`
+		Environments []Environment `yaml:"environments,omitempty"`
 	} `yaml:"metadata"`
 }
 
-// ParsestrithonYml loads a .strithon.yml into the bellyjay1005 struct
-func ParsestrithonYml(s string) (*bellyjay1005, error) {
-	contents := []byte(s)
-	var bellyjay1005Config bellyjay1005
-	err := yaml.Unmarshal(contents, &bellyjay1005Config)
+// Environment is a place the service deploys to. Which fields identify it
+// depends on the cloud.
+type Environment struct {
+	Name  string `yaml:"name"`
+	Cloud string `yaml:"cloud"`
+	// Account is the AWS account id
+	Account AccountNumber `yaml:"account,omitempty"`
+	// Accounts are more AWS account ids, for environments spread over
+	// several accounts
+	Accounts []AccountNumber `yaml:"accounts,omitempty"`
+	// OU is an AWS Organizations OU id or name whose accounts all belong to
+	// the environment
+	OU string `yaml:"ou,omitempty"`
+	// Project is the Google Cloud project id
+	Project string `yaml:"project,omitempty"`
+	// Subscription is the Azure subscription id
+	Subscription string `yaml:"subscription,omitempty"`
+	// Tenant is the Azure tenant id
+	Tenant string `yaml:"tenant,omitempty"`
+	Region string `yaml:"region,omitempty"`
+	// Deploy limits the builds that may deploy to the environment
+	Deploy *DeployRule `yaml:"deploy,omitempty"`
+}
+
+// Target returns the id of the cloud account the environment deploys to:
+// the AWS account, the Google Cloud project or the Azure subscription
+func (e *Environment) Target() string {
+	switch e.Cloud {
+	case cloudGCP:
+		return e.Project
+	case cloudAzure:
+		return e.Subscription
+	}
+	return string(e.Account)
+}
+
+// GetKind returns the kind of the document
+func (b *bellyjay1005) GetKind() string { return b.Kind }
+
+// Resource is a document of a .strithon.yml file
+type Resource interface {
+	GetKind() string
+}
+
+// CloudFormationSpec describes a CloudFormation stack
+type CloudFormationSpec struct {
+	Name                string   `yaml:"name"`
+	Template            string   `yaml:"template"`
+	AdditionalArtifacts []string `yaml:"additional_artifacts,omitempty"`
+	State               string   `yaml:"state,omitempty"`
+}
+
+// CloudFormation is a stack deployed to the service's environments
+type CloudFormation struct {
+	Kind             string             `yaml:"kind"`
+	ClientIdentifier string             `yaml:"client_identifier,omitempty"`
+	Spec             CloudFormationSpec `yaml:"spec"`
+}
+
+// GetKind returns the kind of the document
+func (c *CloudFormation) GetKind() string { return c.Kind }
+
+// GenericResource holds a document of a kind the extension does not know
+type GenericResource struct {
+	Kind string
+	Data map[string]interface{}
+}
+
+// GetKind returns the kind of the document
+func (g *GenericResource) GetKind() string { return g.Kind }
+
+// StrithonFile holds every document of a .strithon.yml file, the service
+// first
+type StrithonFile struct {
+	Resources []Resource
+	// Warnings are problems that do not stop the build, like documents of
+	// an unknown kind
+	Warnings ValidationErrors
+}
+
+// Service returns the service document
+func (f *StrithonFile) Service() *bellyjay1005 {
+	return f.Resources[0].(*bellyjay1005)
+}
+
+// CloudFormation returns the stacks of the file
+func (f *StrithonFile) CloudFormation() []*CloudFormation {
+	stacks := []*CloudFormation{}
+	for _, r := range f.Resources {
+		if c, ok := r.(*CloudFormation); ok {
+			stacks = append(stacks, c)
+		}
+	}
+	return stacks
+}
+
+// ValidationError is a problem found in a .strithon.yml file
+type ValidationError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// ValidationErrors lists every problem found in a .strithon.yml file
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := []string{}
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseOption configures how a .strithon.yml is parsed
+type ParseOption func(*parseOptions)
+
+type parseOptions struct {
+	registry *AccountRegistry
+}
+
+// WithAccountRegistry resolves account aliases with the registry and checks
+// the accounts against it
+func WithAccountRegistry(r *AccountRegistry) ParseOption {
+	return func(o *parseOptions) {
+		o.registry = r
+	}
+}
+
+// ParsestrithonYml validates a .strithon.yml and loads its service
+// document into the bellyjay1005 struct. Problems are returned as
+// ValidationErrors.
+func ParsestrithonYml(s string, opts ...ParseOption) (*bellyjay1005, error) {
+	f, err := ParsestrithonFile(s, opts...)
 	if err != nil {
 		return nil, err
 	}
+	return f.Service(), nil
+}
 
-	return &bellyjay1005Config, nil
+// ParsestrithonFile validates every document of a .strithon.yml and
+// decodes each into a resource by its kind. The first document must be the
+// service, documents of an unknown kind are kept as GenericResource and
+// reported as warnings. Account aliases are replaced by the ids they stand
+// for, so the rest of the extension only sees canonical ids.
+func ParsestrithonFile(s string, opts ...ParseOption) (*StrithonFile, error) {
+	o := &parseOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	docs := []*yaml.Node{}
+	dec := yaml.NewDecoder(bytes.NewBufferString(s))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		// documents holding only comments are skipped
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			continue
+		}
+		docs = append(docs, doc.Content[0])
+	}
+	if len(docs) == 0 {
+		return nil, ValidationErrors{{Message: "the file has no document"}}
+	}
+
+	f := &StrithonFile{}
+	errs := validateService(docs[0])
+	errs = append(errs, resolveAliases(docs[0], o.registry)...)
+	for _, root := range docs[1:] {
+		errs = append(errs, validateDocument(root, f)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	for _, root := range docs {
+		r, err := decodeResource(root)
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		f.Resources = append(f.Resources, r)
+	}
+	return f, nil
+}
+
+// decodeResource decodes a validated document into the type of its kind
+func decodeResource(root *yaml.Node) (Resource, error) {
+	var r Resource
+	switch kind := mappingFields(root)["kind"].Value; kind {
+	case kindService:
+		r = &bellyjay1005{}
+	case kindCloudFormation:
+		r = &CloudFormation{}
+	default:
+		g := &GenericResource{Kind: kind}
+		return g, root.Decode(&g.Data)
+	}
+	return r, root.Decode(r)
+}
+
+// syntaxError turns a yaml error into a ValidationError, keeping the line
+// when the message has one
+func syntaxError(err error) ValidationErrors {
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	line := 0
+	if m := errorLinePattern.FindStringSubmatch(msg); m != nil {
+		line, _ = strconv.Atoi(m[1])
+		msg = strings.TrimSpace(strings.Replace(msg, m[0]+":", "", 1))
+	}
+	return ValidationErrors{{Line: line, Column: 1, Message: msg}}
+}
+
+// schema describes the shape of a yaml node
+type schema struct {
+	kind     yaml.Kind
+	fields   map[string]*schema
+	required []string
+	items    *schema
+	check    func(n *yaml.Node, path string) []ValidationError
+}
+
+var scalarSchema = &schema{kind: yaml.ScalarNode}
+
+var serviceSchema = &schema{
+	kind:     yaml.MappingNode,
+	required: []string{"kind", "metadata"},
+	fields: map[string]*schema{
+		"kind": {kind: yaml.ScalarNode, check: checkServiceKind},
+		"metadata": {
+			kind:     yaml.MappingNode,
+			required: []string{"service"},
+			fields: map[string]*schema{
+				"service": {
+					kind:     yaml.MappingNode,
+					required: []string{"id", "name", "team"},
+					fields: map[string]*schema{
+						"id":     {kind: yaml.ScalarNode, check: checkNotEmpty},
+						"name":   {kind: yaml.ScalarNode, check: checkNotEmpty},
+						"team":   {kind: yaml.ScalarNode, check: checkNotEmpty},
+						"unit":   scalarSchema,
+						"owners": {kind: yaml.SequenceNode, items: scalarSchema},
+						"ms_team": {
+							kind: yaml.MappingNode,
+							fields: map[string]*schema{
+								"name":    scalarSchema,
+								"channel": scalarSchema,
+							},
+						},
+						"description": scalarSchema,
+					},
+				},
+				"environments": {
+					kind:  yaml.SequenceNode,
+					check: checkUniqueNames,
+					items: &schema{
+						kind:     yaml.MappingNode,
+						required: []string{"name", "cloud"},
+						check:    checkEnvironment,
+						fields: map[string]*schema{
+							"name":         {kind: yaml.ScalarNode, check: checkNotEmpty},
+							"cloud":        {kind: yaml.ScalarNode, check: checkCloud},
+							"account":      scalarSchema,
+							"accounts":     {kind: yaml.SequenceNode, items: scalarSchema},
+							"ou":           {kind: yaml.ScalarNode, check: checkNotEmpty},
+							"project":      scalarSchema,
+							"subscription": scalarSchema,
+							"tenant":       scalarSchema,
+							"region":       scalarSchema,
+							"deploy": {
+								kind: yaml.MappingNode,
+								fields: map[string]*schema{
+									"branches": {kind: yaml.SequenceNode, items: scalarSchema},
+									"events":   {kind: yaml.SequenceNode, items: &schema{kind: yaml.ScalarNode, check: checkEvent}},
+									"targets":  {kind: yaml.SequenceNode, items: scalarSchema},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var cloudFormationSchema = &schema{
+	kind:     yaml.MappingNode,
+	required: []string{"kind", "spec"},
+	fields: map[string]*schema{
+		"kind":              scalarSchema,
+		"client_identifier": scalarSchema,
+		"spec": {
+			kind:     yaml.MappingNode,
+			required: []string{"name", "template"},
+			fields: map[string]*schema{
+				"name":                 {kind: yaml.ScalarNode, check: checkNotEmpty},
+				"template":             {kind: yaml.ScalarNode, check: checkNotEmpty},
+				"additional_artifacts": {kind: yaml.SequenceNode, items: scalarSchema},
+				"state":                {kind: yaml.ScalarNode, check: checkState},
+			},
+		},
+	},
+}
+
+// validateService checks a service document against its schema
+func validateService(root *yaml.Node) ValidationErrors {
+	return serviceSchema.validate(root, "")
+}
+
+// validateDocument checks a document after the service against the schema
+// of its kind, adding a warning to f for unknown kinds
+func validateDocument(root *yaml.Node, f *StrithonFile) ValidationErrors {
+	if root.Kind != yaml.MappingNode {
+		return ValidationErrors{nodeError(root, "each document must be a mapping")}
+	}
+	kind := mappingFields(root)["kind"]
+	if kind == nil || kind.Tag == "!!null" {
+		return ValidationErrors{nodeError(root, "missing required field kind")}
+	}
+	switch kind.Value {
+	case kindService:
+		return ValidationErrors{nodeError(kind, "only the first document may be kind %s", kindService)}
+	case kindCloudFormation:
+		return cloudFormationSchema.validate(root, "")
+	}
+	f.Warnings = append(f.Warnings, nodeError(kind, "unknown kind %q is ignored", kind.Value))
+	return nil
+}
+
+func (s *schema) validate(n *yaml.Node, path string) ValidationErrors {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != s.kind {
+		return ValidationErrors{nodeError(n, "%s must be %s", displayPath(path), kindName(s.kind))}
+	}
+	errs := ValidationErrors{}
+	switch n.Kind {
+	case yaml.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			field, ok := s.fields[key.Value]
+			if !ok {
+				errs = append(errs, nodeError(key, "unknown field %s", joinPath(path, key.Value)))
+				continue
+			}
+			// an empty value counts as a missing field
+			if value.Tag == "!!null" {
+				continue
+			}
+			if seen[key.Value] {
+				errs = append(errs, nodeError(key, "%s is set twice", joinPath(path, key.Value)))
+			}
+			seen[key.Value] = true
+			errs = append(errs, field.validate(value, joinPath(path, key.Value))...)
+		}
+		for _, name := range s.required {
+			if !seen[name] {
+				errs = append(errs, nodeError(n, "missing required field %s", joinPath(path, name)))
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			errs = append(errs, s.items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	if s.check != nil {
+		errs = append(errs, s.check(n, path)...)
+	}
+	return errs
+}
+
+func checkServiceKind(n *yaml.Node, path string) []ValidationError {
+	if n.Value == kindService {
+		return nil
+	}
+	if !contains(knownKinds, n.Value) {
+		return []ValidationError{nodeError(n, "unknown kind %q, expected one of %s", n.Value, strings.Join(knownKinds, ", "))}
+	}
+	return []ValidationError{nodeError(n, "the first document must be kind %s, not %s", kindService, n.Value)}
+}
+
+func checkNotEmpty(n *yaml.Node, path string) []ValidationError {
+	if strings.TrimSpace(n.Value) == "" {
+		return []ValidationError{nodeError(n, "%s must not be empty", path)}
+	}
+	return nil
+}
+
+func checkState(n *yaml.Node, path string) []ValidationError {
+	if !contains(knownStates, n.Value) {
+		return []ValidationError{nodeError(n, "%s must be one of %s, not %q", path, strings.Join(knownStates, ", "), n.Value)}
+	}
+	return nil
+}
+
+func checkEvent(n *yaml.Node, path string) []ValidationError {
+	if !contains(knownEvents, n.Value) {
+		return []ValidationError{nodeError(n, "%s must be one of %s, not %q", path, strings.Join(knownEvents, ", "), n.Value)}
+	}
+	return nil
+}
+
+func checkCloud(n *yaml.Node, path string) []ValidationError {
+	if !contains(knownClouds, n.Value) {
+		return []ValidationError{nodeError(n, "%s must be one of %s, not %q", path, strings.Join(knownClouds, ", "), n.Value)}
+	}
+	return nil
+}
+
+// cloudField describes a field of an environment on a given cloud
+type cloudField struct {
+	name     string
+	required bool
+	// list fields hold a sequence of values
+	list bool
+	// alias fields may name a registered account instead, aliases are
+	// checked by resolveAliases
+	alias   bool
+	pattern *regexp.Regexp
+	// format describes the pattern in error messages
+	format string
+}
+
+// cloudFields are the identifying fields of an environment per cloud, any
+// other identifying field is an error
+var cloudFields = map[string][]cloudField{
+	cloudAWS: {
+		{name: "account", alias: true, pattern: awsAccountPattern, format: "a 12 digit AWS account id"},
+		{name: "accounts", list: true, alias: true, pattern: awsAccountPattern, format: "a 12 digit AWS account id"},
+		{name: "ou"},
+		{name: "region", required: true, pattern: awsRegionPattern, format: "an AWS region"},
+	},
+	cloudGCP: {
+		{name: "project", required: true, alias: true, pattern: gcpProjectPattern, format: "a Google Cloud project id"},
+		{name: "region", pattern: gcpRegionPattern, format: "a Google Cloud region"},
+	},
+	cloudAzure: {
+		{name: "subscription", required: true, alias: true, pattern: azureIDPattern, format: "an Azure subscription id"},
+		{name: "tenant", required: true, pattern: azureIDPattern, format: "an Azure tenant id"},
+		{name: "region", pattern: azureRegionPattern, format: "an Azure region"},
+	},
+}
+
+// identityFields are the environment fields that only some clouds use
+var identityFields = []string{"account", "accounts", "ou", "project", "subscription", "tenant", "region"}
+
+// checkEnvironment checks the environment has the fields its cloud needs,
+// in the formats the cloud uses
+func checkEnvironment(n *yaml.Node, path string) []ValidationError {
+	fields := mappingFields(n)
+	cloud := fields["cloud"]
+	if cloud == nil || !contains(knownClouds, cloud.Value) {
+		return nil
+	}
+	errs := []ValidationError{}
+	allowed := []string{}
+	for _, f := range cloudFields[cloud.Value] {
+		allowed = append(allowed, f.name)
+		value := fields[f.name]
+		if value == nil || value.Tag == "!!null" {
+			if f.required {
+				errs = append(errs, nodeError(n, "%s.%s is required for %s environments", path, f.name, cloud.Value))
+			}
+			continue
+		}
+		values := []*yaml.Node{value}
+		if f.list {
+			values = value.Content
+		}
+		for _, v := range values {
+			if f.alias && accountAliasPattern.MatchString(v.Value) {
+				continue
+			}
+			if f.pattern != nil && !f.pattern.MatchString(v.Value) {
+				errs = append(errs, nodeError(v, "%s.%s must be %s, not %q", path, f.name, f.format, v.Value))
+			}
+		}
+	}
+	// an AWS environment names its accounts one way or another
+	if cloud.Value == cloudAWS && fields["account"] == nil && fields["accounts"] == nil && fields["ou"] == nil {
+		errs = append(errs, nodeError(n, "%s needs an account, accounts or ou for aws environments", path))
+	}
+	for _, name := range identityFields {
+		if value := fields[name]; value != nil && !contains(allowed, name) {
+			errs = append(errs, nodeError(value, "%s.%s is not used by %s environments", path, name, cloud.Value))
+		}
+	}
+	return errs
+}
+
+// resolveAliases replaces the account aliases of the service's environments
+// with their ids and checks the accounts may be used where the environments
+// deploy to
+func resolveAliases(root *yaml.Node, registry *AccountRegistry) ValidationErrors {
+	errs := ValidationErrors{}
+	envs := mappingFields(mappingFields(root)["metadata"])["environments"]
+	if envs == nil || envs.Kind != yaml.SequenceNode {
+		return errs
+	}
+	for i, item := range envs.Content {
+		path := fmt.Sprintf("metadata.environments[%d]", i)
+		fields := mappingFields(item)
+		cloud, region := fields["cloud"], ""
+		if cloud == nil {
+			continue
+		}
+		if r := fields["region"]; r != nil {
+			region = r.Value
+		}
+		for _, f := range cloudFields[cloud.Value] {
+			value := fields[f.name]
+			if !f.alias || value == nil || value.Tag == "!!null" {
+				continue
+			}
+			values := []*yaml.Node{value}
+			if f.list {
+				values = value.Content
+			}
+			for _, v := range values {
+				if v.Kind != yaml.ScalarNode {
+					continue
+				}
+				alias, acct, ok := registry.lookup(v.Value)
+				switch {
+				case ok:
+					if reason := acct.allows(cloud.Value, region); reason != "" {
+						errs = append(errs, nodeError(v, "%s.%s %s (%s) %s", path, f.name, alias, acct.ID, reason))
+					}
+					v.Value, v.Tag = acct.ID, "!!str"
+				case !f.pattern.MatchString(v.Value):
+					// values that are neither an id nor an alias are
+					// reported by the schema
+					if accountAliasPattern.MatchString(v.Value) {
+						errs = append(errs, nodeError(v, "%s.%s %q is not %s nor a registered account alias", path, f.name, v.Value, f.format))
+					}
+				case registry != nil && registry.Strict:
+					errs = append(errs, nodeError(v, "%s.%s %s is not in the account registry", path, f.name, v.Value))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func checkUniqueNames(n *yaml.Node, path string) []ValidationError {
+	seen := map[string]bool{}
+	errs := []ValidationError{}
+	for _, item := range n.Content {
+		name := mappingFields(item)["name"]
+		if name == nil {
+			continue
+		}
+		if seen[name.Value] {
+			errs = append(errs, nodeError(name, "environment %s is listed twice", name.Value))
+		}
+		seen[name.Value] = true
+	}
+	return errs
+}
+
+// mappingFields returns the value nodes of a mapping by key
+func mappingFields(n *yaml.Node) map[string]*yaml.Node {
+	fields := map[string]*yaml.Node{}
+	if n == nil || n.Kind != yaml.MappingNode {
+		return fields
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		fields[n.Content[i].Value] = n.Content[i+1]
+	}
+	return fields
+}
+
+func nodeError(n *yaml.Node, format string, args ...interface{}) ValidationError {
+	return ValidationError{Line: n.Line, Column: n.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "the document"
+	}
+	return path
+}
+
+func kindName(k yaml.Kind) string {
+	switch k {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	return "a single value"
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -2,7 +2,10 @@ package plugin
 
 import (
 	"io/ioutil"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParse(t *testing.T) {
@@ -66,3 +69,178 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		yml  string
+		errs []string
+	}{
+		{
+			name: "unknown field",
+			yml:  "kind: service\nmetadata:\n  service:\n    id: a\n    name: b\n    team: c\n    colour: blue\n",
+			errs: []string{"line 7, column 5: unknown field metadata.service.colour"},
+		},
+		{
+			name: "missing fields",
+			yml:  "kind: service\nmetadata:\n  service:\n    id: a\n    name:\n",
+			errs: []string{
+				"line 4, column 5: missing required field metadata.service.name",
+				"line 4, column 5: missing required field metadata.service.team",
+			},
+		},
+		{
+			name: "unknown kind",
+			yml:  "kind: lambda\nmetadata:\n  service: {id: a, name: b, team: c}\n",
+			errs: []string{`line 1, column 7: unknown kind "lambda", expected one of service, aws-cloudformation`},
+		},
+		{
+			name: "bad environment",
+			yml: "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n  environments:\n" +
+				"    - {name: qa, cloud: openstack, account: \"1\", region: us-east-1}\n",
+			errs: []string{`line 5, column 25: metadata.environments[0].cloud must be one of aws, gcp, azure, not "openstack"`},
+		},
+		{
+			name: "wrong type",
+			yml:  "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n  environments: qa\n",
+			errs: []string{"line 4, column 17: metadata.environments must be a list"},
+		},
+		{
+			name: "syntax",
+			yml:  "kind: service\n\tmetadata:\n",
+			errs: []string{"line 2, column 1: found a tab character that violates indentation"},
+		},
+	}
+	for _, c := range cases {
+		_, err := ParsestrithonYml(c.yml)
+		errs, ok := err.(ValidationErrors)
+		if !assert.True(t, ok, "%s: %v", c.name, err) {
+			continue
+		}
+		got := []string{}
+		for _, e := range errs {
+			got = append(got, e.Error())
+		}
+		assert.Equal(t, c.errs, got, c.name)
+	}
+
+	b, _ := ioutil.ReadFile("testdata/.strithon-invalid.yml")
+	_, err := ParsestrithonYml(string(b))
+	assert.EqualError(t, err, strings.Join([]string{
+		"line 8, column 5: unknown field metadata.service.owner",
+		`line 12, column 16: metadata.environments[0].account must be a 12 digit AWS account id, not "11111111111"`,
+		`line 17, column 15: metadata.environments[1].region must be an AWS region, not "us-east"`,
+		"line 14, column 13: environment qa is listed twice",
+	}, "; "))
+}
+
+func TestParseFile(t *testing.T) {
+	b, _ := ioutil.ReadFile("testdata/.strithon-multiple.yml")
+	f, err := ParsestrithonFile(string(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, f.Resources, 2)
+	assert.Empty(t, f.Warnings)
+	assert.Equal(t, "aws-config-check-extension", f.Service().Metadata.Service.Name)
+	stacks := f.CloudFormation()
+	if assert.Len(t, stacks, 1) {
+		assert.Equal(t, "demo", stacks[0].ClientIdentifier)
+		assert.Equal(t, CloudFormationSpec{
+			Name:                "drone-metrics-collector",
+			Template:            "templates/resource.yml",
+			AdditionalArtifacts: []string{"deployment.zip"},
+		}, stacks[0].Spec)
+	}
+
+	// the repository's own file
+	b, _ = ioutil.ReadFile("../.strithon.yml")
+	f, err = ParsestrithonFile(string(b))
+	if assert.NoError(t, err) && assert.Len(t, f.CloudFormation(), 1) {
+		assert.Equal(t, stateDelete, f.CloudFormation()[0].Spec.State)
+	}
+
+	service := "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n"
+
+	// unknown kinds are kept and reported as warnings
+	f, err = ParsestrithonFile(service + "---\nkind: lambda\nspec:\n  handler: main\n")
+	if assert.NoError(t, err) && assert.Len(t, f.Resources, 2) {
+		assert.Equal(t, &GenericResource{
+			Kind: "lambda",
+			Data: map[string]interface{}{"kind": "lambda", "spec": map[string]interface{}{"handler": "main"}},
+		}, f.Resources[1])
+		assert.EqualError(t, f.Warnings, `line 5, column 7: unknown kind "lambda" is ignored`)
+	}
+
+	// later documents are validated against the schema of their kind, with
+	// lines counted from the start of the file
+	_, err = ParsestrithonFile(service + "---\nkind: aws-cloudformation\nspec:\n  name: stack\n  state: gone\n---\nkind: service\n---\nfoo: bar\n")
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 8, column 10: spec.state must be one of present, delete, not "gone"`,
+		"line 7, column 3: missing required field spec.template",
+		"line 10, column 7: only the first document may be kind service",
+		"line 12, column 1: missing required field kind",
+	}, "; "))
+}
+
+func TestParseClouds(t *testing.T) {
+	b, _ := ioutil.ReadFile("testdata/.strithon-clouds.yml")
+	m, err := ParsestrithonYml(string(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	targets := []string{}
+	for _, env := range m.Metadata.Environments {
+		targets = append(targets, env.Target())
+	}
+	assert.Equal(t, []string{"111111111111", "strithon-prod-1", "8f0e1a2b-3c4d-4e5f-8a9b-0c1d2e3f4a5b"}, targets)
+	assert.Equal(t, "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", m.Metadata.Environments[2].Tenant)
+
+	b, _ = ioutil.ReadFile("testdata/.strithon-ou.yml")
+	m, err = ParsestrithonYml(string(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []AccountNumber{"111111111111", "666666666666"}, m.Metadata.Environments[0].Accounts)
+	assert.Equal(t, "payments", m.Metadata.Environments[1].OU)
+
+	service := "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n  environments:\n"
+	cases := []struct {
+		env  string
+		errs []string
+	}{
+		{
+			env: "{name: qa, cloud: gcp, account: \"111111111111\", region: us-east-1}",
+			errs: []string{
+				"line 5, column 7: metadata.environments[0].project is required for gcp environments",
+				`line 5, column 63: metadata.environments[0].region must be a Google Cloud region, not "us-east-1"`,
+				"line 5, column 39: metadata.environments[0].account is not used by gcp environments",
+			},
+		},
+		{
+			env: "{name: qa, cloud: azure, subscription: nope}",
+			errs: []string{
+				"line 5, column 7: metadata.environments[0].tenant is required for azure environments",
+				`line 5, column 46: metadata.environments[0].subscription "nope" is not an Azure subscription id nor a registered account alias`,
+			},
+		},
+		{
+			env:  "{name: qa, cloud: aws, region: us-east-1}",
+			errs: []string{"line 5, column 7: metadata.environments[0] needs an account, accounts or ou for aws environments"},
+		},
+		{
+			env:  "{name: qa, cloud: aws, accounts: [\"111111111111\", \"12\"], region: us-east-1}",
+			errs: []string{`line 5, column 57: metadata.environments[0].accounts must be a 12 digit AWS account id, not "12"`},
+		},
+		{
+			env: "{name: qa, cloud: aws, account: \"111111111111\", region: us-east-1, project: p}",
+			errs: []string{
+				"line 5, column 83: metadata.environments[0].project is not used by aws environments",
+			},
+		},
+	}
+	for _, c := range cases {
+		_, err := ParsestrithonYml(service + "    - " + c.env + "\n")
+		assert.EqualError(t, err, strings.Join(c.errs, "; "), c.env)
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
@@ -17,6 +18,8 @@ import (
 	"github.com/drone/drone-go/plugin/config"
 	"github.com/drone/drone-yaml/yaml"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -34,6 +37,46 @@ type Plugin struct {
 	apiEndpointQA string
 	ssm           ssmiface.SSMAPI
 	client        *github.Client
+	authorizer    Authorizer
+	shadow        Authorizer
+	settings      *Settings
+	auditor       *Auditor
+	credentials   map[string]CredentialHook
+	teams         TeamMembership
+	notifier      *Notifier
+	// shadows tracks the shadow comparisons still running
+	shadows sync.WaitGroup
+}
+
+// Option configures optional parts of the plugin
+type Option func(*Plugin)
+
+// WithAuthorizer replaces the remote auth api with another Authorizer
+func WithAuthorizer(a Authorizer) Option {
+	return func(p *Plugin) {
+		p.authorizer = a
+	}
+}
+
+// WithShadowAuthorizer evaluates a candidate policy next to the live one
+func WithShadowAuthorizer(a Authorizer) Option {
+	return func(p *Plugin) {
+		p.shadow = a
+	}
+}
+
+// WithSettings configures the plugin from the extension settings
+func WithSettings(s *Settings) Option {
+	return func(p *Plugin) {
+		p.settings = s
+	}
+}
+
+// WithAuditor records an audit event for every config request
+func WithAuditor(a *Auditor) Option {
+	return func(p *Plugin) {
+		p.auditor = a
+	}
 }
 
 // APIResponse is the structure for Auth0 API responses
@@ -44,18 +87,44 @@ type APIResponse struct {
 	TokenType   string `json:"token_type"`
 }
 
+// String describes the response without the token
+func (r APIResponse) String() string {
+	return fmt.Sprintf("{AccessToken:%s Scope:%s ExpiresIn:%d TokenType:%s}", redacted, r.Scope, r.ExpiresIn, r.TokenType)
+}
+
 // AuthRequest is the structure for auth API requests
 type AuthRequest struct {
-	Input struct {
-		Accounts []string `json:"accounts"`
-		Repo     string   `json:"repo"`
-	} `json:"input"`
+	Input AuthInput `json:"input"`
+}
+
+// AuthInput is the policy input sent to the auth API
+type AuthInput struct {
+	Accounts     []string          `json:"accounts"`
+	Repo         string            `json:"repo"`
+	Team         string            `json:"team,omitempty"`
+	Branch       string            `json:"branch,omitempty"`
+	Environments []AuthEnvironment `json:"environments,omitempty"`
+}
+
+// AuthEnvironment pairs an environment name with the account it deploys to.
+// Account is the AWS account, Google Cloud project or Azure subscription.
+type AuthEnvironment struct {
+	Name    string `json:"name"`
+	Account string `json:"account"`
+	Cloud   string `json:"cloud,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// OU is the path of OUs the account was found through
+	OU string `json:"ou,omitempty"`
+	// Alias and Owner are the registry alias and owning team of the account
+	Alias string `json:"alias,omitempty"`
+	Owner string `json:"owner,omitempty"`
 }
 
 // AuthResponse is the structure for auth API responses
 type AuthResponse struct {
-	Result     bool   `json:"result"`
-	DecisionID string `json:"decision_id"`
+	Result     AuthResult `json:"result"`
+	DecisionID string     `json:"decision_id"`
 }
 
 // TokenData holds an array of strings for token state
@@ -70,8 +139,8 @@ type TokenState struct {
 // New returns a new permission check plugin.
 func New(
 	server, token, apiToken, host, auth0Endpoint, authEndpoint, apiEndpoint, apiEndpointQA string,
-	ssm ssmiface.SSMAPI, client *github.Client) *Plugin {
-	return &Plugin{
+	ssm ssmiface.SSMAPI, client *github.Client, opts ...Option) *Plugin {
+	p := &Plugin{
 		server:        server,
 		token:         token,
 		apiToken:      apiToken,
@@ -82,11 +151,24 @@ func New(
 		apiEndpointQA: apiEndpointQA,
 		ssm:           ssm,
 		client:        client,
+		authorizer:    NewRemoteAuthorizer(authEndpoint, defaultAuthTimeout),
+		settings:      &Settings{},
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	if p.teams == nil {
+		p.teams = p.settings.NewTeamMembership(client)
+	}
+	return p
 }
 
 // GetAuth0APIKey returns a bearer token with the user data embeded
-func (p *Plugin) GetAuth0APIKey(req *config.Request, env string) (string, error) {
+func (p *Plugin) GetAuth0APIKey(ctx context.Context, req *config.Request, env string) (key string, err error) {
+	ctx, span := startSpan(ctx, "GetAuth0APIKey", req)
+	span.SetAttributes(attribute.String("strithon.environment", env))
+	defer func() { endSpan(span, err) }()
+	log := logger(ctx)
 	user := req.Build.Sender
 
 	url := p.auth0Endpoint
@@ -94,17 +176,19 @@ func (p *Plugin) GetAuth0APIKey(req *config.Request, env string) (string, error)
 	withDecryption := true
 	path := fmt.Sprintf("/%s/auth0/", env)
 
-	params, _ := p.ssm.GetParametersByPath(&ssm.GetParametersByPathInput{
+	start := time.Now()
+	params, err := p.ssm.GetParametersByPath(&ssm.GetParametersByPathInput{
 		Path:           &path,
 		WithDecryption: &withDecryption,
 	})
+	observeUpstream(upstreamSSM, start, err)
 	var secret *string
 	var id *string
 	if params == nil {
 		return "", fmt.Errorf("No parameters found under the path %s", path)
 	}
 	for _, param := range params.Parameters {
-		logrus.Debugf("Param and name: %v, %s", param, *param.Name)
+		log.Debugf("Param name: %s", *param.Name)
 		if strings.HasSuffix(*param.Name, "client-id") {
 			id = param.Value
 		}
@@ -113,11 +197,11 @@ func (p *Plugin) GetAuth0APIKey(req *config.Request, env string) (string, error)
 		}
 	}
 	if id == nil {
-		logrus.Errorf("Client id not found")
+		log.Errorf("Client id not found")
 		return "", errors.New("Client ID not found")
 	}
 	if secret == nil {
-		logrus.Errorf("Client secret not found")
+		log.Errorf("Client secret not found")
 		return "", errors.New("Client secret not found")
 	}
 
@@ -128,28 +212,35 @@ func (p *Plugin) GetAuth0APIKey(req *config.Request, env string) (string, error)
 	link := strings.Replace(req.Repo.Link, "https://", "", 1)
 
 	payload, err := GeneratePayload(*id, *secret, audience, user, link)
-	logrus.Debugf("Payload %s", payload)
 	if err != nil {
-		logrus.Errorf("Unable to marshal token state")
+		log.Errorf("Unable to marshal token state")
 		return "", err
 	}
 
 	payloadReader := strings.NewReader(payload)
-	areq, _ := http.NewRequest("POST", url, payloadReader)
+	areq, _ := http.NewRequestWithContext(ctx, "POST", url, payloadReader)
 
 	areq.Header.Add("content-type", "application/json")
 
-	res, _ := http.DefaultClient.Do(areq)
-
+	start = time.Now()
+	res, err := tracedClient.Do(areq)
+	if err == nil && res.StatusCode >= 300 {
+		res.Body.Close()
+		err = fmt.Errorf("Auth0 answered with status %d", res.StatusCode)
+	}
+	observeUpstream(upstreamAuth0, start, err)
+	if err != nil {
+		log.Errorf("Error fetching the auth0 token: %v", err)
+		return "", err
+	}
 	defer res.Body.Close()
-	body, _ := ioutil.ReadAll(res.Body)
-
-	logrus.Debug(res)
 
 	var apiRes APIResponse
-	logrus.Debug(string(body))
-	json.Unmarshal(body, &apiRes)
-	logrus.Debug(apiRes)
+	if err = json.NewDecoder(res.Body).Decode(&apiRes); err != nil {
+		log.Errorf("Error reading the auth0 token: %v", err)
+		return "", err
+	}
+	log.Debugf("Auth0 token received: %s", apiRes)
 	return apiRes.AccessToken, nil
 }
 
@@ -166,18 +257,23 @@ func GeneratePayload(id string, secret string, audience string, user string, lin
 	if err != nil {
 		return "", err
 	}
-	logrus.Debugf("Marshalled State: %s", string(marshalledState))
 	escapedState := strconv.Quote(string(marshalledState))
 	payload := fmt.Sprintf(`{"client_id":"%s","client_secret":"%s","audience":"%s","grant_type":"client_credentials","drone_username":"%s","state":%s}`, id, secret, audience, user, escapedState)
 	return payload, nil
 }
 
 // EncryptData uses the drone api to encrypt a string
-func (p *Plugin) EncryptData(content string, req *config.Request) (string, error) {
-	// create an http client with oauth authentication.
+func (p *Plugin) EncryptData(ctx context.Context, content string, req *config.Request) (enc string, err error) {
+	ctx, span := startSpan(ctx, "EncryptData", req)
+	defer func() { endSpan(span, err) }()
+
+	// create an http client with oauth authentication. The drone client
+	// takes no context, the transport adds it to propagate the span.
 	config := new(oauth2.Config)
 	auther := config.Client(
-		oauth2.NoContext,
+		context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+			Transport: &contextTransport{ctx: ctx, next: tracingTransport},
+		}),
 		&oauth2.Token{
 			AccessToken: p.apiToken,
 		},
@@ -192,17 +288,27 @@ func (p *Plugin) EncryptData(content string, req *config.Request) (string, error
 		Name:      req.Repo.Name,
 		Data:      content,
 	}
+	start := time.Now()
 	encrypted, err := client.Encrypt(req.Repo.Namespace, req.Repo.Name, secret)
+	observeUpstream(upstreamDrone, start, err)
 	if err != nil {
-		logrus.Debugf("Error encrypting: %v", err)
+		logger(ctx).Debugf("Error encrypting: %v", err)
 		return "", err
 	}
 	return encrypted, nil
 }
 
-func injectSteps(pipe *yaml.Pipeline, secretName string) {
+// injectSteps adds the secret to the steps of the pipeline. With matchers,
+// deploy steps for another environment do not get the secret.
+func injectSteps(pipe *yaml.Pipeline, secretName string, env string, matchers []StepMatcher, build *drone.Build) {
 	// Add the secret to each environment
 	for _, step := range pipe.Steps {
+		if len(matchers) > 0 {
+			deploy, target := deployStep(step, build, nil, matchers)
+			if deploy && target != "" && target != env {
+				continue
+			}
+		}
 		if step.Environment == nil {
 			step.Environment = map[string]*yaml.Variable{}
 		}
@@ -210,33 +316,38 @@ func injectSteps(pipe *yaml.Pipeline, secretName string) {
 	}
 }
 
+// tokenSecretName is the name of the secret holding the api token for env
+func tokenSecretName(env string) string {
+	if env == "pr" {
+		return "DEMO_API_TOKEN"
+	}
+	return fmt.Sprintf("DEMO_API_TOKEN_%s", strings.ToUpper(env))
+}
+
 // InjectKey takes in a .drone.yml file and inserts an api token for the given env
-func (p *Plugin) InjectKey(content string, req *config.Request, env string) (string, string, error) {
+func (p *Plugin) InjectKey(ctx context.Context, content string, req *config.Request, env string) (string, string, error) {
 	// Get the key to inject into the .drone.yml
-	key, err := p.GetAuth0APIKey(req, env)
+	key, err := p.GetAuth0APIKey(ctx, req, env)
 	if err != nil {
-		logrus.Errorf("Error fetching auth0 api key: %v", err)
+		logger(ctx).Errorf("Error fetching auth0 api key: %v", err)
 		return "", "", err
 	}
 
 	// Encrypt the key using the drone api
-	enc, err := p.EncryptData(key, req)
+	enc, err := p.EncryptData(ctx, key, req)
 	if err != nil {
-		logrus.Debugf("Error encrypting: %s", err)
+		logger(ctx).Debugf("Error encrypting: %s", err)
 		return content, "", err
 	}
 
 	// Parse the .drone.yml file
-	manifest, err := yaml.Parse(strings.NewReader(content))
+	manifest, err := parseManifest(ctx, content)
 	if err != nil {
-		logrus.Errorf("Error parsing drone config: %s", err)
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
 		return "", "", err
 	}
 
-	secretName := "DEMO_API_TOKEN"
-	if env != "pr" {
-		secretName = fmt.Sprintf("%s_%s", secretName, strings.ToUpper(env))
-	}
+	secretName := tokenSecretName(env)
 	hasPipes := false
 	// Find the pipeline in the manifest
 	for _, r := range manifest.Resources {
@@ -245,10 +356,10 @@ func (p *Plugin) InjectKey(content string, req *config.Request, env string) (str
 			continue
 		}
 		hasPipes = true
-		injectSteps(v, secretName)
+		injectSteps(v, secretName, env, p.settings.Matchers, &req.Build)
 	}
 	if hasPipes == false {
-		logrus.Errorf("Pipeline not found in config file")
+		logger(ctx).Errorf("Pipeline not found in config file")
 		return "", "", errors.New("Pipeline not found in config file")
 	}
 	// Add the secret to the manifest
@@ -266,9 +377,20 @@ func (p *Plugin) InjectKey(content string, req *config.Request, env string) (str
 }
 
 // GetGithubFile downloads a specific file from GitHub.
-func (p *Plugin) GetGithubFile(ctx context.Context, req *config.Request, org, name, file string) (string, error) {
-	opts := &github.RepositoryContentGetOptions{Ref: req.Build.After}
+func (p *Plugin) GetGithubFile(ctx context.Context, req *config.Request, org, name, file string) (content string, err error) {
+	return p.getGithubFile(ctx, req, org, name, file, req.Build.After)
+}
+
+// getGithubFile downloads a file at a ref, the default branch when ref is
+// empty
+func (p *Plugin) getGithubFile(ctx context.Context, req *config.Request, org, name, file, ref string) (content string, err error) {
+	ctx, span := startSpan(ctx, "GetGithubFile", req)
+	span.SetAttributes(attribute.String("github.file", file), attribute.String("github.ref", ref))
+	defer func() { endSpan(span, err) }()
+	opts := &github.RepositoryContentGetOptions{Ref: ref}
+	start := time.Now()
 	data, _, _, err := p.client.Repositories.GetContents(ctx, org, name, file, opts)
+	observeUpstream(upstreamGithub, start, err)
 	if err != nil {
 		return "error", err
 	}
@@ -280,7 +402,7 @@ func (p *Plugin) GetGithubFile(ctx context.Context, req *config.Request, org, na
 		return "", nil
 	}
 
-	content, err := data.GetContent()
+	content, err = data.GetContent()
 	if err != nil {
 		return "bad data", err
 	}
@@ -289,109 +411,286 @@ func (p *Plugin) GetGithubFile(ctx context.Context, req *config.Request, org, na
 }
 
 // Validate will validate the .strithon.yml file for the given user
-func (p *Plugin) Validate(ctx context.Context, req *config.Request, token string) ([]string, error) {
+func (p *Plugin) Validate(ctx context.Context, req *config.Request, token string) (*Decision, error) {
+	d, _, err := p.validate(ctx, req, token)
+	return d, err
+}
+
+// validate is Validate, also returning the parsed .strithon.yml
+func (p *Plugin) validate(ctx context.Context, req *config.Request, token string) (d *Decision, f *StrithonFile, err error) {
+	ctx, span := startSpan(ctx, "Validate", req)
+	defer func() { endSpan(span, err) }()
 
 	// get the .strithon.yml file from the github repository
 	content, err := p.GetGithubFile(ctx, req, req.Repo.Namespace, req.Repo.Name, ".strithon.yml")
+	if isNotFound(err) {
+		return nil, nil, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if content == "" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	// parse the .strithon.yml file
-	bellyjay1005Config, err := ParsestrithonYml(content)
+	_, parseSpan := otel.Tracer(tracerName).Start(ctx, "yaml.Parse")
+	strithonFile, err := ParsestrithonFile(content, WithAccountRegistry(&p.settings.Registry))
+	endSpan(parseSpan, err)
 	if err != nil {
-		logrus.Debugf("Error parsing the .strithon.yml file: %v", err)
-		return nil, err
+		logger(ctx).Debugf("Error parsing the .strithon.yml file: %v", err)
+		return nil, nil, err
+	}
+	for _, warning := range strithonFile.Warnings {
+		logger(ctx).Warnf("Warning in the .strithon.yml file of %s: %s", req.Repo.Slug, warning)
 	}
+	bellyjay1005Config := strithonFile.Service()
+
+	org := req.Repo.Namespace
+	sender := req.Build.Sender
 
 	// get the list of aws accounts from the .strithon.yml file, no duplicates
+	var in AuthRequest
+	in.Input.Repo = GetRepoLink(req.Repo.Link)
+	in.Input.Team = p.verifiedTeam(ctx, org, sender, bellyjay1005Config.Metadata.Service.Team)
+	in.Input.Branch = buildBranch(&req.Build)
+	in.Input.Accounts = []string{}
 	acctMap := make(map[string]bool)
 	for _, env := range bellyjay1005Config.Metadata.Environments {
-		acctMap[string(env.Account)] = true
-	}
-	accts := []string{}
-	for k := range acctMap {
-		accts = append(accts, k)
+		// environments may deploy to several accounts, each is checked
+		accounts, err := p.settings.Organizations.environmentAccounts(env)
+		if err != nil {
+			return nil, nil, ValidationErrors{{Message: err.Error()}}
+		}
+		for _, acct := range accounts {
+			alias, registered, _ := p.settings.Registry.lookup(acct.Account)
+			in.Input.Environments = append(in.Input.Environments, AuthEnvironment{
+				Name:    env.Name,
+				Account: acct.Account,
+				Cloud:   env.Cloud,
+				Tenant:  env.Tenant,
+				Region:  env.Region,
+				OU:      acct.OU,
+				Alias:   alias,
+				Owner:   registered.Team,
+			})
+			if acctMap[acct.Account] {
+				continue
+			}
+			acctMap[acct.Account] = true
+			in.Input.Accounts = append(in.Input.Accounts, acct.Account)
+		}
 	}
 
 	// see if the accounts are allowed with the auth api
-	if len(accts) > 0 {
-		payloadContent := fmt.Sprintf(`{"input":{"accounts":["%v"],"repo":"%s"}}`, strings.Join(accts, `","`), GetRepoLink(req.Repo.Link))
-		payload := strings.NewReader(payloadContent)
-		logrus.Debugf("Payload to the auth api: %s", payloadContent)
-		logrus.Debugf("Auth endpoint: %s", p.authEndpoint)
-		request, _ := http.NewRequest("POST", p.authEndpoint+"/v1/data/demo/drone/allow", payload)
-
-		request.Header.Add("Content-Type", "application/json")
-		request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-
-		res, err := http.DefaultClient.Do(request)
-		if err != nil {
-			logrus.Errorf("Error calling auth api: %v", err)
-			return nil, err
+	if len(in.Input.Accounts) == 0 {
+		return &Decision{Allowed: true}, strithonFile, nil
+	}
+	// protection and deploy rules are decided with the default branch too,
+	// read only when there are any
+	var trusted *trust
+	if len(p.settings.Ownership.Protected) > 0 || len(p.settings.Restrictions.Environments) > 0 {
+		trusted = p.loadTrust(ctx, req)
+	}
+	shadow := startShadow(ctx, p.shadow, &in, token)
+	authRes, err := p.authorizer.Authorize(ctx, &in, token)
+	if err != nil {
+		logger(ctx).Errorf("Auth api unavailable for %s: %v", in.Input.Repo, err)
+		d, err = applyOutage(&in, &p.settings.Outage, err)
+		if err == nil {
+			p.checkOwnership(ctx, req, &in, d, trusted)
+			p.checkRestrictions(ctx, &req.Build, bellyjay1005Config, &in, d, trusted)
 		}
-		defer res.Body.Close()
-		body, _ := ioutil.ReadAll(res.Body)
-
-		logrus.Debugf("Auth api response: %v", res)
+		return d, strithonFile, err
+	}
+	decision := NewDecision(&in, authRes)
+	logger(ctx).WithFields(logrus.Fields{
+		"repo":        in.Input.Repo,
+		"decision_id": decision.ID,
+		"allowed":     decision.Allowed,
+	}).Infof("Auth decision: %s", decision)
+	span.SetAttributes(
+		attribute.Bool("strithon.allowed", decision.Allowed),
+		attribute.String("strithon.decision_id", decision.ID),
+	)
+	p.recordShadow(ctx, req, &in, decision, shadow)
+	// ownership and deploy rules are checked apart from the policy, so
+	// shadow comparisons only see what the policies said
+	p.checkOwnership(ctx, req, &in, decision, trusted)
+	p.checkRestrictions(ctx, &req.Build, bellyjay1005Config, &in, decision, trusted)
+	return decision, strithonFile, nil
+}
 
-		var authRes AuthResponse
-		logrus.Debug(string(body))
-		err = json.Unmarshal(body, &authRes)
-		if err != nil {
-			logrus.Errorf("Error unmarshalling %s: %s\n\n", string(body), err)
-			return nil, err
-		}
-		logrus.Debugf("Auth response: %v", authRes)
-		if !authRes.Result {
-			return accts, nil
+// deniedSteps returns the deploy steps of the pipeline that target a denied
+// environment
+func deniedSteps(pipe *yaml.Pipeline, decision *Decision, build *drone.Build, matchers []StepMatcher, generated generatedSteps) []*yaml.Container {
+	denied, mapped := decision.DeniedEnvironments()
+	steps := []*yaml.Container{}
+	for _, step := range pipe.Steps {
+		if deploy, env := generated.deployStep(pipe, step, build, decision.Environments, matchers); deploy {
+			// leave deploys to allowed environments alone, a step that
+			// cannot be tied to an environment is replaced to be safe
+			if mapped && env != "" && !denied[env] {
+				continue
+			}
+			steps = append(steps, step)
 		}
 	}
-	return []string{}, nil
+	return steps
 }
 
-func injectWarnings(pipe *yaml.Pipeline, repo string, org string, accounts []string) error {
-	for _, step := range pipe.Steps {
-		if strings.Contains(step.Image, "plugin") {
-			step.Image = "alpine"
-			step.Name = fmt.Sprintf("%s-unauthorized", step.Name)
-			step.Commands = []string{fmt.Sprintf("%s/%s is unauthorized to deploy to accounts %v. Update permissions in https://github.com/bellyjay1005/aws-drone-policy.", org, repo, accounts)}
+// injectWarnings replaces the denied deploy steps and returns their
+// original names
+func injectWarnings(pipe *yaml.Pipeline, repo string, org string, decision *Decision, build *drone.Build, settings *Settings, generated generatedSteps) ([]string, error) {
+	if settings == nil {
+		settings = &Settings{}
+	}
+	names := []string{}
+	for _, step := range deniedSteps(pipe, decision, build, settings.Matchers, generated) {
+		names = append(names, step.Name)
+		renameStep(pipe, step, fmt.Sprintf("%s-unauthorized", step.Name))
+		if err := settings.Denial.denialStep(step, fmt.Sprintf("%s/%s", org, repo), decision); err != nil {
+			return names, err
 		}
 	}
-	return nil
+	return names, nil
 }
 
-func (p *Plugin) replaceWarnings(content string, repo string, org string, accounts []string) (string, error) {
-	manifest, err := yaml.Parse(strings.NewReader(content))
+func (p *Plugin) replaceWarnings(ctx context.Context, content string, repo string, org string, decision *Decision, build *drone.Build, generated generatedSteps) (string, []string, error) {
+	manifest, err := parseManifest(ctx, content)
 	if err != nil {
-		logrus.Errorf("Error parsing drone config: %s", err)
-		return "", err
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
 	}
 	hasPipes := false
+	replaced := []string{}
 	for _, r := range manifest.Resources {
 		v, ok := r.(*yaml.Pipeline)
 		if !ok {
 			continue
 		}
 		hasPipes = true
-		injectWarnings(v, repo, org, accounts)
+		names, err := injectWarnings(v, repo, org, decision, build, p.settings, generated)
+		if err != nil {
+			logger(ctx).Errorf("Error building the denial step: %s", err)
+			return "", nil, err
+		}
+		replaced = append(replaced, names...)
 	}
 	if hasPipes == false {
-		logrus.Errorf("Pipeline not found in config file")
+		logger(ctx).Errorf("Pipeline not found in config file")
+		return "", nil, err
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, replaced, nil
+}
+
+func (p *Plugin) replaceOutageWarnings(ctx context.Context, content string, decision *Decision) (string, error) {
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
 		return "", err
 	}
+	for _, r := range manifest.Resources {
+		v, ok := r.(*yaml.Pipeline)
+		if !ok {
+			continue
+		}
+		injectOutageWarning(v, decision)
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, nil
+}
+
+func (p *Plugin) replaceAdvisory(ctx context.Context, content string, req *config.Request, decision *Decision, generated generatedSteps) (string, []string, error) {
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
+	}
+	flagged := []string{}
+	for _, r := range manifest.Resources {
+		v, ok := r.(*yaml.Pipeline)
+		if !ok {
+			continue
+		}
+		steps := injectAdvisory(v, req.Repo.Slug, decision, &req.Build, p.settings, generated)
+		if len(steps) == 0 {
+			continue
+		}
+		logger(ctx).WithFields(logrus.Fields{
+			"repo":        req.Repo.Slug,
+			"pipeline":    v.Name,
+			"decision_id": decision.ID,
+		}).Warnf("Deploy steps would be replaced: %s", strings.Join(decision.Reasons(), "; "))
+		flagged = append(flagged, steps...)
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, flagged, nil
+}
+
+// replaceInvalid makes every pipeline fail with the problems found in
+// .strithon.yml, dropping the injected tokens. In audit mode the pipelines
+// run unchanged after a non-blocking step listing the problems.
+func (p *Plugin) replaceInvalid(ctx context.Context, content string, errs ValidationErrors, mode string) (string, error) {
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", err
+	}
+	resources := []yaml.Resource{}
+	for _, r := range manifest.Resources {
+		switch v := r.(type) {
+		case *yaml.Pipeline:
+			if mode == enforcementAudit {
+				p.settings.Denial.invalidAdvisory(v, errs)
+			} else {
+				p.settings.Denial.invalidPipeline(v, errs)
+			}
+		case *yaml.Secret:
+			if mode != enforcementAudit {
+				continue
+			}
+		}
+		resources = append(resources, r)
+	}
+	manifest.Resources = resources
 	newContent, _ := manifest.Encode()
 	content = fmt.Sprintf("---\n%s", string(newContent))
 	return content, nil
 }
 
 // Find will find the .strithon.yml config file in the GitHub repo and get it
-func (p *Plugin) Find(ctx context.Context, req *config.Request) (*drone.Config, error) {
-	logrus.Debug(ctx)
-	logrus.Debug(req)
+func (p *Plugin) Find(ctx context.Context, req *config.Request) (res *drone.Config, err error) {
+	logger(ctx).WithFields(logrus.Fields{
+		"repo":   req.Repo.Slug,
+		"build":  req.Build.Number,
+		"commit": req.Build.After,
+		"event":  req.Build.Event,
+	}).Debug("Config requested")
+	ctx, span := startSpan(ctx, "Find", req)
+	event := newAuditEvent(auditConfig, req)
+	var service *bellyjay1005
+	defer func() {
+		if err != nil {
+			event.Decision = auditError
+			event.Error = err.Error()
+		}
+		p.auditor.Record(event)
+		note := newNotification(event, req, p.host)
+		if service != nil {
+			note.Team = service.Metadata.Service.MSTeam.Name
+			note.Channel = service.Metadata.Service.MSTeam.Channel
+		}
+		p.notifier.Notify(note)
+		countDecision(event.Decision)
+		span.SetAttributes(attribute.String("strithon.decision", event.Decision))
+		endSpan(span, err)
+	}()
+
 	// get the drone configuration file from the github repository
 	content, err := p.GetGithubFile(ctx, req, req.Repo.Namespace, req.Repo.Name, req.Repo.Config)
 	if err != nil {
@@ -400,40 +699,143 @@ func (p *Plugin) Find(ctx context.Context, req *config.Request) (*drone.Config,
 	if content == "" {
 		return nil, nil
 	}
+	violations, err := p.lintGuardrails(ctx, content, req.Repo.Slug)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range violations {
+		event.Guardrails = append(event.Guardrails, v.String())
+	}
 
 	// inject the api keys
 	envs := []string{"qa", "pr"}
 	var token string
 	var key string
 	for _, env := range envs {
-		content, key, err = p.InjectKey(content, req, env)
+		content, key, err = p.InjectKey(ctx, content, req, env)
 		if env == os.Getenv("ENV") {
 			token = key
 		}
 		if err != nil {
-			logrus.Errorf("Error doing the injection for environment %s: %s", env, err)
+			logger(ctx).Errorf("Error doing the injection for environment %s: %s", env, err)
 			return nil, err
 		}
+		event.Secrets = append(event.Secrets, tokenSecretName(env))
+		countToken(env)
 	}
 
 	// check permission for the repo to deploy to those accounts
-	accts, err := p.Validate(ctx, req, token)
+	decision, strithonFile, err := p.validate(ctx, req, token)
+	var invalid ValidationErrors
+	if errors.As(err, &invalid) {
+		logger(ctx).Warnf("Invalid .strithon.yml in %s: %s", req.Repo.Slug, invalid)
+		event.Decision = auditInvalid
+		event.Error = invalid.Error()
+		mode := p.settings.Enforcement.Mode(req.Repo.Namespace, req.Repo.Slug)
+		content, err = p.replaceInvalid(ctx, content, invalid, mode)
+		if err != nil {
+			return nil, err
+		}
+		// an invalid file doesn't excuse the pipelines from the guardrails
+		content, err = p.guardPipelines(ctx, req, content, violations, event)
+		if err != nil {
+			return nil, err
+		}
+		content, event.Mirrored, err = p.mirrorImages(ctx, content)
+		if err != nil {
+			return nil, err
+		}
+		return &drone.Config{
+			Data: content,
+			Kind: "drone.v1.yaml",
+		}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	logrus.Debugf("Result from validate: %v, err: %v", accts, err)
-	if len(accts) > 0 {
+	logger(ctx).Debugf("Result from validate: %v, err: %v", decision, err)
+	var generated generatedSteps
+	if strithonFile != nil {
+		service = strithonFile.Service()
+		content, generated, err = p.addCloudFormationSteps(ctx, content, strithonFile, &req.Build, event.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		if len(generated) > 0 {
+			event.Generated = generated.names()
+		}
+		content, err = p.addCredentials(ctx, content, strithonFile, &req.Build, generated)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a .strithon.yml without accounts checks nothing, so it counts as missing
+	if (decision == nil || len(decision.Requested) == 0) && p.settings.Require.Required(req.Repo.Namespace, req.Repo.Slug) {
+		empty := decision != nil
+		if empty {
+			logger(ctx).WithField("repo", req.Repo.Slug).Warn("Deploy steps replaced, the .strithon.yml lists no environments")
+		} else {
+			logger(ctx).WithField("repo", req.Repo.Slug).Warn("Deploy steps replaced, the repo has no .strithon.yml")
+		}
+		event.Decision = auditMissing
+		content, event.Steps, err = p.replaceMissing(ctx, content, req, empty)
+		if err != nil {
+			return nil, err
+		}
+		decision = nil
+	}
+	mode := p.settings.Enforcement.Mode(req.Repo.Namespace, req.Repo.Slug)
+	event.setDecision(decision, mode)
+	if decision != nil && !decision.Allowed && mode == enforcementAudit {
+		content, event.Steps, err = p.replaceAdvisory(ctx, content, req, decision, generated)
+		if err != nil {
+			return nil, err
+		}
+	} else if decision != nil && !decision.Allowed {
 		repo := req.Repo.Name
 		org := req.Repo.Namespace
-		var newPipe, err = p.replaceWarnings(content, repo, org, accts)
+		logger(ctx).WithFields(logrus.Fields{
+			"repo":        req.Repo.Slug,
+			"sender":      req.Build.Sender,
+			"decision_id": decision.ID,
+			"accounts":    decision.Accounts(),
+		}).Warnf("Deploy steps replaced: %s", strings.Join(decision.Reasons(), "; "))
+		content, event.Steps, err = p.replaceWarnings(ctx, content, repo, org, decision, &req.Build, generated)
 		if err != nil {
 			return nil, err
 		}
-		// var pipeToString = string(pipe)
-		return &drone.Config{
-			Data: newPipe,
-			Kind: "drone.v1.yaml",
-		}, nil
+		if len(decision.Restricted) > 0 {
+			var withheld []string
+			content, withheld, err = p.withholdTokens(ctx, content, decision.Restricted)
+			if err != nil {
+				return nil, err
+			}
+			secrets := []string{}
+			for _, secret := range event.Secrets {
+				if !contains(withheld, secret) {
+					secrets = append(secrets, secret)
+				}
+			}
+			event.Secrets = secrets
+		}
+	}
+	if decision != nil && len(decision.FailOpen) > 0 {
+		logger(ctx).WithFields(logrus.Fields{
+			"repo":         req.Repo.Slug,
+			"environments": decision.FailOpen,
+		}).Warn("Deploys allowed without a permission check, the authorization service is unavailable")
+		content, err = p.replaceOutageWarnings(ctx, content, decision)
+		if err != nil {
+			return nil, err
+		}
+	}
+	content, err = p.guardPipelines(ctx, req, content, violations, event)
+	if err != nil {
+		return nil, err
+	}
+	content, event.Mirrored, err = p.mirrorImages(ctx, content)
+	if err != nil {
+		return nil, err
 	}
 
 	return &drone.Config{
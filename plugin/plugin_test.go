@@ -1,7 +1,9 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -151,7 +153,7 @@ func TestGetAuth0APIKey(t *testing.T) {
 				Sender: "name",
 			},
 		}
-		got, err := p.GetAuth0APIKey(&req, env)
+		got, err := p.GetAuth0APIKey(noContext, &req, env)
 		if got != c.want {
 			t.Errorf("got api key %s, wanted %s", got, c.want)
 		}
@@ -195,7 +197,7 @@ func TestEncryptData(t *testing.T) {
 				Name:      "name",
 			},
 		}
-		got, _ := p.EncryptData("content", &req)
+		got, _ := p.EncryptData(noContext, "content", &req)
 		if got != r.want {
 			t.Errorf("got %s, but expected %s", got, r.want)
 		}
@@ -356,7 +358,7 @@ func TestInjectKey(t *testing.T) {
 			},
 		}
 		// TODO: qa testing
-		got, token, err := p.InjectKey(c.content, &req, c.env)
+		got, token, err := p.InjectKey(noContext, c.content, &req, c.env)
 		if got != string(c.want) {
 			t.Errorf("%s: got %s, but expected %s", c.namespace, got, c.want)
 		}
@@ -445,6 +447,9 @@ func TestValidate(t *testing.T) {
 		} else if strings.HasPrefix(r.URL.EscapedPath(), "/repos/no-environ") {
 			out, _ := ioutil.ReadFile("testdata/contents-no-environ.json")
 			w.Write(out)
+		} else if strings.HasPrefix(r.URL.EscapedPath(), "/repos/multi-env") {
+			out, _ := ioutil.ReadFile("testdata/contents-multi-env.json")
+			w.Write(out)
 		} else if strings.HasPrefix(r.URL.EscapedPath(), "/v1") {
 			b, _ := ioutil.ReadAll(r.Body)
 			var body AuthRequest
@@ -452,12 +457,16 @@ func TestValidate(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Error unmarshalling request body")
 			}
+			if body.Input.Repo == "github.com/multi-env/prod-denied" {
+				w.Write([]byte(`{"decision_id":"7d1c4f3e","result":{"allow":false,"denials":[{"account":"222222222222","environment":"prod","reason":"repo is not in the prod allow list"}]}}`))
+				return
+			}
 			result := true
 			if body.Input.Repo == "noaccess" {
 				result = false
 			}
 			resp := AuthResponse{
-				Result:     result,
+				Result:     AuthResult{Allow: result},
 				DecisionID: "506a05fc-8354-415b-b6b5-e32e8af60255",
 			}
 			out, err := json.Marshal(resp)
@@ -483,8 +492,10 @@ func TestValidate(t *testing.T) {
 	cases := []struct {
 		name      string
 		namespace string
+		link      string
 		err       bool
 		valid     bool
+		denied    []string
 		ssm       mockedSSM
 	}{
 		{
@@ -517,6 +528,22 @@ func TestValidate(t *testing.T) {
 				err:     false,
 			},
 		},
+		{
+			name:      "only prod account denied",
+			namespace: "multi-env",
+			link:      "https://github.com/multi-env/prod-denied",
+			err:       false,
+			valid:     false,
+			denied:    []string{"222222222222"},
+		},
+		{
+			name:      "every account denied by a boolean result",
+			namespace: "multi-env",
+			link:      "noaccess",
+			err:       false,
+			valid:     false,
+			denied:    []string{"111111111111", "222222222222"},
+		},
 		{
 			name:      "no strithon.yml contents",
 			namespace: "nil",
@@ -546,17 +573,21 @@ func TestValidate(t *testing.T) {
 				Namespace: c.namespace,
 				Slug:      "octocat/hello-world",
 				Config:    ".drone.yml",
+				Link:      c.link,
 			},
 		}
 
 		p := New(ts.URL, mockToken, "", ts.URL, ts.URL, ts.URL, "", "", c.ssm, client)
-		invalidAccts, err := p.Validate(noContext, req, "")
+		decision, err := p.Validate(noContext, req, "")
 
 		if c.err == (err == nil) {
 			t.Errorf("%v Expected receiving error to be %v, but got %v", c.name, c.err, err)
 		}
-		if (c.valid) != (len(invalidAccts) < 1 && invalidAccts != nil) {
-			t.Errorf("%v Expected file validity to be %v, but received %v", c.name, c.valid, invalidAccts)
+		if (c.valid) != (decision != nil && decision.Allowed) {
+			t.Errorf("%v Expected file validity to be %v, but received %v", c.name, c.valid, decision)
+		}
+		if c.denied != nil {
+			assert.Equal(t, c.denied, decision.Accounts(), c.name)
 		}
 	}
 }
@@ -570,18 +601,26 @@ func TestInjectWarnings(t *testing.T) {
 	}
 	var repo = "unicorn_plugin"
 	var org = "bellyjay1005"
-	var accounts = []string{"fake_qa", "fake_prod"}
+	var decision = &Decision{
+		ID: "506a05fc-8354-415b-b6b5-e32e8af60255",
+		Denials: []Denial{
+			{Account: "fake_qa", Environment: "qa"},
+			{Account: "fake_prod", Environment: "prod", Reason: "repo is not in the prod allow list"},
+		},
+	}
 	for _, r := range manifest.Resources {
 		v, ok := r.(*yaml.Pipeline)
 		if !ok {
 			continue
 		}
-		injectWarnings(v, repo, org, accounts)
+		injectWarnings(v, repo, org, decision, &drone.Build{}, nil, nil)
 	}
 	newContent, _ := manifest.Encode()
 	var got = fmt.Sprintf("---\n%s", string(newContent))
 	var want = "Update permissions in https://github.com/bellyjay1005/aws-drone-policy."
 	assert.Contains(t, got, want, "error message %s", "formatted")
+	assert.Contains(t, got, "account fake_prod (environment prod): repo is not in the prod allow list")
+	assert.Contains(t, got, "Decision ID: 506a05fc-8354-415b-b6b5-e32e8af60255")
 }
 
 func TestReplaceWarnings(t *testing.T) {
@@ -589,9 +628,11 @@ func TestReplaceWarnings(t *testing.T) {
 	var yamlContent = string(yamlFile)
 	var repo = "bigfoot_plugin"
 	var org = "bellyjay1005"
-	var accounts = []string{"fake_qa", "fake_prod"}
+	var decision = &Decision{
+		Denials: []Denial{{Account: "fake_qa"}, {Account: "fake_prod"}},
+	}
 	p := New("", "", "", "", "", "", "", "", nil, nil)
-	var got, _ = p.replaceWarnings(yamlContent, repo, org, accounts)
+	var got, _, _ = p.replaceWarnings(noContext, yamlContent, repo, org, decision, &drone.Build{}, nil)
 	var want = "Update permissions in https://github.com/bellyjay1005/aws-drone-policy."
 	print(got)
 	assert.Containsf(t, got, want, "error message %s", "formatted")
@@ -617,7 +658,7 @@ func TestFind(t *testing.T) {
 				t.Fatalf("did a thing wrong")
 			}
 			resp := AuthResponse{
-				Result:     true,
+				Result:     AuthResult{Allow: true},
 				DecisionID: "506a05fc-8354-415b-b6b5-e32e8af60255",
 			}
 			out, err := json.Marshal(resp)
@@ -777,3 +818,156 @@ func TestFind(t *testing.T) {
 		}
 	}
 }
+
+func TestFindInvalidStrithonYml(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-invalid.yml", "")
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	p := newFindPlugin(ts, WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := yaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, r := range manifest.Resources {
+		pipe, ok := r.(*yaml.Pipeline)
+		if !assert.True(t, ok, "unexpected %s resource", r.GetKind()) {
+			continue
+		}
+		if assert.Len(t, pipe.Steps, 1) {
+			assert.Equal(t, invalidStepName, pipe.Steps[0].Name)
+			assert.Contains(t, pipe.Steps[0].Commands[0], "line 8, column 5: unknown field metadata.service.owner")
+			assert.Equal(t, "exit 1", pipe.Steps[0].Commands[1])
+		}
+	}
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, auditInvalid, e.Decision)
+		assert.Contains(t, e.Error, "environment qa is listed twice")
+	}
+}
+
+func TestFindInvalidStrithonYmlAuditMode(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-invalid.yml", "")
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	settings := &Settings{Enforcement: EnforcementSettings{Namespaces: map[string]string{"org": enforcementAudit}}}
+	p := newFindPlugin(ts, WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := yaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the pipeline runs unchanged after the advisory
+	pipe := manifest.Resources[0].(*yaml.Pipeline)
+	names := []string{}
+	for _, step := range pipe.Steps {
+		names = append(names, step.Name)
+	}
+	assert.Equal(t, []string{advisoryStepName, "test", "deploy-qa", "deploy-prod", "smoke-prod"}, names)
+	assert.Equal(t, "ignore", pipe.Steps[0].Failure)
+	assert.Contains(t, pipe.Steps[0].Commands[0], "unknown field metadata.service.owner")
+	assert.Len(t, pipe.Steps[0].Commands, 1)
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, auditInvalid, e.Decision)
+	}
+}
+
+// contentsResponse wraps a testdata file in a GitHub contents api response
+func contentsResponse(file string) []byte {
+	b, _ := ioutil.ReadFile(file)
+	out, _ := json.Marshal(&github.RepositoryContent{
+		Type:     github.String("file"),
+		Encoding: github.String("base64"),
+		Content:  github.String(base64.StdEncoding.EncodeToString(b)),
+	})
+	return out
+}
+
+// newFindServer mocks GitHub, the drone encrypt api, auth0 and the auth api.
+// The repository serves droneFile as its drone config and strithonFile as
+// its .strithon.yml, and the auth api answers with authBody.
+func newFindServer(t *testing.T, droneFile, strithonFile, authBody string) *httptest.Server {
+	return newFindServerRefs(t, droneFile, map[string]string{"": strithonFile}, authBody)
+}
+
+// newFindServerRefs is newFindServer with a .strithon.yml per ref, the ""
+// entry serving every other ref
+func newFindServerRefs(t *testing.T, droneFile string, strithonFiles map[string]string, authBody string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		switch {
+		case strings.HasPrefix(path, "/api/repos"):
+			w.Write([]byte(`{"data": "YXNkZgo="}`))
+		case strings.HasPrefix(path, "/v1"):
+			w.Write([]byte(authBody))
+		case strings.HasSuffix(path, "/.strithon.yml"):
+			strithonFile, ok := strithonFiles[r.URL.Query().Get("ref")]
+			if !ok {
+				strithonFile = strithonFiles[""]
+			}
+			if strithonFile == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(contentsResponse(strithonFile))
+		case strings.HasPrefix(path, "/repos"):
+			w.Write(contentsResponse(droneFile))
+		default:
+			w.Write([]byte(`{"access_token": "token"}`))
+		}
+	}))
+}
+
+// newFindPlugin returns a plugin wired to a server from newFindServer
+func newFindPlugin(ts *httptest.Server, opts ...Option) *Plugin {
+	clientKey := "/pr/auth0/client-id"
+	secretKey := "/pr/auth0/client-secret"
+	params := ssm.GetParametersByPathOutput{
+		Parameters: []*ssm.Parameter{
+			{Name: &clientKey, Value: &clientKey},
+			{Name: &secretKey, Value: &secretKey},
+		},
+	}
+	fakeSSM := mockedSSM{
+		respPathMap: map[string]ssm.GetParametersByPathOutput{
+			"/pr/auth0/": params,
+			"/qa/auth0/": params,
+		},
+	}
+	trans := oauth2.NewClient(noContext, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: mockToken},
+	))
+	client, _ := github.NewEnterpriseClient(ts.URL, ts.URL, trans)
+	return New(ts.URL, mockToken, "faketoken", ts.URL, ts.URL, ts.URL, "", "", fakeSSM, client, opts...)
+}
+
+// findRequest is a config request for the org/name repository
+func findRequest() *config.Request {
+	return &config.Request{
+		Build: drone.Build{
+			After:  "a1afc9b699274831f841d1fd8ace0f5e91d92711",
+			Sender: "octocat",
+			Target: "master",
+			Event:  "push",
+		},
+		Repo: drone.Repo{
+			Namespace: "org",
+			Name:      "name",
+			Slug:      "org/name",
+			Link:      "https://github.com/org/name",
+			Config:    ".drone.yml",
+		},
+	}
+}
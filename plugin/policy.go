@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"gopkg.in/yaml.v2"
+)
+
+// PolicyRule grants the matching repositories access to accounts. Every
+// list is a set of glob patterns and an empty list matches anything, except
+// accounts which must be listed.
+type PolicyRule struct {
+	Repos        []string `yaml:"repos"`
+	Orgs         []string `yaml:"orgs"`
+	Teams        []string `yaml:"teams"`
+	Accounts     []string `yaml:"accounts"`
+	Environments []string `yaml:"environments"`
+	Branches     []string `yaml:"branches"`
+	// Clouds limits the rule to environments on these clouds
+	Clouds []string `yaml:"clouds"`
+	// Tenants limits the rule to Azure environments of these tenants
+	Tenants []string `yaml:"tenants"`
+}
+
+// LocalPolicy is an in-process Authorizer evaluating a list of rules
+type LocalPolicy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// ParsePolicy loads policy rules from yaml or json
+func ParsePolicy(b []byte) (*LocalPolicy, error) {
+	var policy LocalPolicy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// LoadPolicyFile loads policy rules from a local file
+func LoadPolicyFile(file string) (*LocalPolicy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(b)
+}
+
+// FetchPolicyBundle loads policy rules from a file in a GitHub repository
+func FetchPolicyBundle(ctx context.Context, client *github.Client, owner, name, file, ref string) (*LocalPolicy, error) {
+	opts := &github.RepositoryContentGetOptions{Ref: ref}
+	data, _, _, err := client.Repositories.GetContents(ctx, owner, name, file, opts)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("Policy bundle %s not found in %s/%s", file, owner, name)
+	}
+	content, err := data.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy([]byte(content))
+}
+
+// Authorize evaluates every environment of the request against the rules
+func (l *LocalPolicy) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	envs := in.Input.Environments
+	// accounts without environments are checked on their own
+	if len(envs) == 0 {
+		for _, acct := range in.Input.Accounts {
+			envs = append(envs, AuthEnvironment{Account: acct})
+		}
+	}
+
+	res := &AuthResponse{DecisionID: newDecisionID()}
+	for _, env := range envs {
+		if reason := l.deny(&in.Input, env); reason != "" {
+			res.Result.Denials = append(res.Result.Denials, Denial{
+				Account:     env.Account,
+				Environment: env.Name,
+				Reason:      reason,
+			})
+		}
+	}
+	res.Result.Allow = len(res.Result.Denials) == 0
+	logger(ctx).Debugf("Local policy result: %v", res)
+	return res, nil
+}
+
+// deny returns why the environment is not allowed, or "" when a rule allows it
+func (l *LocalPolicy) deny(in *AuthInput, env AuthEnvironment) string {
+	org := repoOrg(in.Repo)
+	reason := fmt.Sprintf("no policy rule allows %s to deploy to account %s", in.Repo, env.Account)
+	for _, rule := range l.Rules {
+		if !matchAny(rule.Repos, in.Repo) || !matchAny(rule.Orgs, org) || !matchAny(rule.Teams, in.Team) {
+			continue
+		}
+		if len(rule.Accounts) == 0 || !matchAny(rule.Accounts, env.Account) {
+			continue
+		}
+		if !matchAny(rule.Clouds, envCloud(env)) || !matchAny(rule.Tenants, env.Tenant) {
+			continue
+		}
+		if !matchAny(rule.Environments, env.Name) {
+			reason = fmt.Sprintf("account %s is not allowed for environment %s", env.Account, env.Name)
+			continue
+		}
+		if !matchAny(rule.Branches, in.Branch) {
+			reason = fmt.Sprintf("branch %s may not deploy to account %s", in.Branch, env.Account)
+			continue
+		}
+		return ""
+	}
+	return reason
+}
+
+// envCloud returns the cloud of the environment, AWS when it is not set
+func envCloud(env AuthEnvironment) string {
+	if env.Cloud == "" {
+		return cloudAWS
+	}
+	return env.Cloud
+}
+
+// matchAny reports whether the value matches one of the glob patterns, an
+// empty pattern list matches anything
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// repoOrg returns the organization of a repository link such as
+// github.com/org/name
+func repoOrg(repo string) string {
+	parts := strings.Split(strings.Trim(repo, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// newDecisionID returns a random identifier for locally made decisions
+func newDecisionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("local-%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestLocalPolicyAuthorize(t *testing.T) {
+	policy, err := LoadPolicyFile("testdata/policy.yml")
+	if err != nil {
+		t.Fatalf("Error loading policy: %v", err)
+	}
+	envs := []AuthEnvironment{
+		{Name: "qa", Account: "111111111111"},
+		{Name: "prod", Account: "222222222222"},
+	}
+	cases := []struct {
+		name   string
+		input  AuthInput
+		denied []string
+	}{
+		{
+			name:  "every environment allowed",
+			input: AuthInput{Repo: "github.com/bellyjay1005/service", Team: "sarahconnor", Branch: "master"},
+		},
+		{
+			name:   "prod from a feature branch",
+			input:  AuthInput{Repo: "github.com/bellyjay1005/service", Team: "sarahconnor", Branch: "feature"},
+			denied: []string{"222222222222"},
+		},
+		{
+			name:   "prod from another team",
+			input:  AuthInput{Repo: "github.com/bellyjay1005/service", Team: "skynet", Branch: "master"},
+			denied: []string{"222222222222"},
+		},
+		{
+			name:   "unknown org",
+			input:  AuthInput{Repo: "github.com/other/service", Team: "sarahconnor", Branch: "master"},
+			denied: []string{"111111111111", "222222222222"},
+		},
+	}
+	for _, c := range cases {
+		in := &AuthRequest{Input: c.input}
+		in.Input.Environments = envs
+		res, err := policy.Authorize(noContext, in, "")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		decision := NewDecision(in, res)
+		assert.Equal(t, len(c.denied) == 0, decision.Allowed, c.name)
+		assert.Equal(t, append([]string{}, c.denied...), decision.Accounts(), c.name)
+		assert.Contains(t, res.DecisionID, "local-", c.name)
+	}
+}
+
+func TestLocalPolicyDenialReason(t *testing.T) {
+	policy, _ := ParsePolicy([]byte(`rules: [{repos: ["*/org/*"], accounts: ["1"], environments: [qa]}]`))
+	in := &AuthRequest{Input: AuthInput{
+		Repo:         "github.com/org/repo",
+		Environments: []AuthEnvironment{{Name: "prod", Account: "1"}},
+	}}
+	res, _ := policy.Authorize(noContext, in, "")
+	if assert.Len(t, res.Result.Denials, 1) {
+		assert.Equal(t, "account 1 is not allowed for environment prod", res.Result.Denials[0].Reason)
+	}
+}
+
+func TestFetchPolicyBundle(t *testing.T) {
+	rules := base64.StdEncoding.EncodeToString([]byte(`rules: [{accounts: ["*"]}]`))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/repos/platform/policy/contents/drone/rules.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"type":"file","encoding":"base64","content":"%s"}`, rules)))
+	}))
+	defer ts.Close()
+
+	trans := oauth2.NewClient(noContext, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: mockToken},
+	))
+	client, _ := github.NewEnterpriseClient(ts.URL, ts.URL, trans)
+
+	policy, err := FetchPolicyBundle(noContext, client, "platform", "policy", "drone/rules.yml", "master")
+	if assert.NoError(t, err) {
+		assert.Len(t, policy.Rules, 1)
+	}
+	_, err = FetchPolicyBundle(noContext, client, "platform", "missing", "drone/rules.yml", "master")
+	assert.Error(t, err)
+}
+
+func TestLocalPolicyClouds(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - orgs: [bellyjay1005]
+    accounts: ["*"]
+    clouds: [aws, gcp]
+  - orgs: [bellyjay1005]
+    accounts: ["*"]
+    clouds: [azure]
+    tenants: ["0a1b2c3d-*"]
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	in := &AuthRequest{Input: AuthInput{Repo: "github.com/bellyjay1005/service"}}
+	in.Input.Environments = []AuthEnvironment{
+		{Name: "qa", Account: "111111111111"},
+		{Name: "analytics", Account: "strithon-prod-1", Cloud: cloudGCP},
+		{Name: "prod", Account: "8f0e1a2b", Cloud: cloudAzure, Tenant: "0a1b2c3d-4e5f"},
+		{Name: "other", Account: "9f0e1a2b", Cloud: cloudAzure, Tenant: "ffffffff-4e5f"},
+	}
+	res, _ := policy.Authorize(noContext, in, "")
+	assert.Equal(t, []string{"9f0e1a2b"}, NewDecision(in, res).Accounts())
+}
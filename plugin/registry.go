@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"gopkg.in/yaml.v2"
+)
+
+// RegisteredAccount is a cloud account known to the account registry
+type RegisteredAccount struct {
+	// ID is the AWS account id, Google Cloud project id or Azure
+	// subscription id the alias stands for
+	ID string `yaml:"id"`
+	// Team owns the account
+	Team string `yaml:"team"`
+	// Clouds and Regions restrict where the account may be used, any when
+	// empty
+	Clouds  []string `yaml:"clouds"`
+	Regions []string `yaml:"regions"`
+}
+
+// AccountRegistry maps account aliases, like payments-prod, to the accounts
+// they stand for. Aliases may be listed inline, in a file, in a file of a
+// GitHub repository, or any mix of those. Inline aliases win.
+type AccountRegistry struct {
+	File string `yaml:"file"`
+	// Repo is an owner/name repository holding the registry in Path
+	Repo string `yaml:"repo"`
+	Path string `yaml:"path"`
+	// Ref is the branch, tag or commit of Repo to read
+	Ref string `yaml:"ref"`
+	// Strict rejects account ids that are not in the registry
+	Strict   bool                         `yaml:"strict"`
+	Accounts map[string]RegisteredAccount `yaml:"accounts"`
+}
+
+// load adds the aliases of the registry file
+func (r *AccountRegistry) load() error {
+	if r.File == "" {
+		return r.merge(nil, "settings")
+	}
+	b, err := ioutil.ReadFile(r.File)
+	if err != nil {
+		return err
+	}
+	return r.merge(b, r.File)
+}
+
+// Fetch adds the aliases of the registry file in Repo, it does nothing when
+// no repo is set
+func (r *AccountRegistry) Fetch(ctx context.Context, client *github.Client) error {
+	if r.Repo == "" {
+		return nil
+	}
+	parts := strings.SplitN(r.Repo, "/", 2)
+	if len(parts) != 2 || r.Path == "" {
+		return fmt.Errorf("Account registry needs a repo and path")
+	}
+	opts := &github.RepositoryContentGetOptions{Ref: r.Ref}
+	data, _, _, err := client.Repositories.GetContents(ctx, parts[0], parts[1], r.Path, opts)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("Account registry %s not found in %s", r.Path, r.Repo)
+	}
+	content, err := data.GetContent()
+	if err != nil {
+		return err
+	}
+	return r.merge([]byte(content), r.Repo+"/"+r.Path)
+}
+
+// merge adds the aliases of a registry file that are not set yet and checks
+// every alias has an id
+func (r *AccountRegistry) merge(b []byte, source string) error {
+	var file AccountRegistry
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("Error parsing account registry %s: %v", source, err)
+	}
+	if r.Accounts == nil {
+		r.Accounts = map[string]RegisteredAccount{}
+	}
+	for alias, acct := range file.Accounts {
+		if _, ok := r.Accounts[alias]; !ok {
+			r.Accounts[alias] = acct
+		}
+	}
+	for alias, acct := range r.Accounts {
+		if acct.ID == "" {
+			return fmt.Errorf("Account %s of the registry %s has no id", alias, source)
+		}
+	}
+	return nil
+}
+
+// lookup finds an account by alias or id, returning its alias
+func (r *AccountRegistry) lookup(ref string) (string, RegisteredAccount, bool) {
+	if r == nil {
+		return "", RegisteredAccount{}, false
+	}
+	if acct, ok := r.Accounts[ref]; ok {
+		return ref, acct, true
+	}
+	for alias, acct := range r.Accounts {
+		if acct.ID == ref {
+			return alias, acct, true
+		}
+	}
+	return "", RegisteredAccount{}, false
+}
+
+// allows returns why the account may not be used by an environment of the
+// cloud in the region, or an empty string when it may
+func (a RegisteredAccount) allows(cloud, region string) string {
+	if len(a.Clouds) > 0 && !contains(a.Clouds, cloud) {
+		return fmt.Sprintf("is not allowed for %s environments", cloud)
+	}
+	if region != "" && len(a.Regions) > 0 && !contains(a.Regions, region) {
+		return fmt.Sprintf("is not allowed in region %s", region)
+	}
+	return ""
+}
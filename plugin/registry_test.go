@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func testRegistry(t *testing.T) *AccountRegistry {
+	r := &AccountRegistry{File: "testdata/registry.yml"}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseAliasesWithoutMetadata(t *testing.T) {
+	// documents the schema rejects are still safe to resolve
+	for _, doc := range []string{"kind: service\n", "hello\n", "kind: service\nmetadata:\n"} {
+		var err error
+		assert.NotPanics(t, func() {
+			_, err = ParsestrithonFile(doc, WithAccountRegistry(testRegistry(t)))
+		}, doc)
+		var errs ValidationErrors
+		assert.True(t, errors.As(err, &errs), doc)
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	b, _ := ioutil.ReadFile("testdata/.strithon-aliases.yml")
+	m, err := ParsestrithonYml(string(b), WithAccountRegistry(testRegistry(t)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, AccountNumber("111111111111"), m.Metadata.Environments[0].Account)
+	assert.Equal(t, []AccountNumber{"222222222222", "333333333333"}, m.Metadata.Environments[1].Accounts)
+
+	// aliases need a registry
+	_, err = ParsestrithonYml(string(b))
+	assert.EqualError(t, err, strings.Join([]string{
+		`line 11, column 16: metadata.environments[0].account "payments-qa" is not a 12 digit AWS account id nor a registered account alias`,
+		`line 15, column 18: metadata.environments[1].accounts "payments-prod" is not a 12 digit AWS account id nor a registered account alias`,
+	}, "; "))
+
+	service := "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n  environments:\n"
+	cases := []struct {
+		env    string
+		strict bool
+		errs   []string
+	}{
+		{
+			env:  "{name: prod, cloud: aws, account: payments-prod, region: eu-west-1}",
+			errs: []string{"line 5, column 41: metadata.environments[0].account payments-prod (222222222222) is not allowed in region eu-west-1"},
+		},
+		{
+			env:  "{name: prod, cloud: aws, account: \"222222222222\", region: eu-west-1}",
+			errs: []string{"line 5, column 41: metadata.environments[0].account payments-prod (222222222222) is not allowed in region eu-west-1"},
+		},
+		{
+			env:  "{name: analytics, cloud: aws, account: analytics, region: us-east-1}",
+			errs: []string{"line 5, column 46: metadata.environments[0].account analytics (strithon-prod-1) is not allowed for aws environments"},
+		},
+		{
+			env:    "{name: qa, cloud: aws, account: \"999999999999\", region: us-east-1}",
+			strict: true,
+			errs:   []string{"line 5, column 39: metadata.environments[0].account 999999999999 is not in the account registry"},
+		},
+		{
+			env: "{name: analytics, cloud: gcp, project: analytics}",
+		},
+	}
+	for _, c := range cases {
+		r := testRegistry(t)
+		r.Strict = c.strict
+		_, err := ParsestrithonYml(service+"    - "+c.env+"\n", WithAccountRegistry(r))
+		if len(c.errs) == 0 {
+			assert.NoError(t, err, c.env)
+			continue
+		}
+		assert.EqualError(t, err, strings.Join(c.errs, "; "), c.env)
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	r := &AccountRegistry{
+		File:     "testdata/registry.yml",
+		Accounts: map[string]RegisteredAccount{"payments-qa": {ID: "444444444444"}},
+	}
+	if !assert.NoError(t, r.load()) {
+		return
+	}
+	// inline aliases win over the file
+	assert.Equal(t, "444444444444", r.Accounts["payments-qa"].ID)
+	assert.Equal(t, "data", r.Accounts["analytics"].Team)
+
+	r = &AccountRegistry{Accounts: map[string]RegisteredAccount{"payments-qa": {Team: "payments"}}}
+	assert.EqualError(t, r.load(), "Account payments-qa of the registry settings has no id")
+}
+
+func TestFetchRegistry(t *testing.T) {
+	registry := base64.StdEncoding.EncodeToString([]byte(`accounts: {payments-qa: {id: "111111111111"}}`))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/repos/platform/accounts/contents/registry.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf(`{"type":"file","encoding":"base64","content":"%s"}`, registry)))
+	}))
+	defer ts.Close()
+
+	trans := oauth2.NewClient(noContext, oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: mockToken},
+	))
+	client, _ := github.NewEnterpriseClient(ts.URL, ts.URL, trans)
+
+	r := &AccountRegistry{Repo: "platform/accounts", Path: "registry.yml", Ref: "main"}
+	if assert.NoError(t, r.Fetch(noContext, client)) {
+		assert.Equal(t, "111111111111", r.Accounts["payments-qa"].ID)
+	}
+	r = &AccountRegistry{Repo: "platform/missing", Path: "registry.yml"}
+	assert.Error(t, r.Fetch(noContext, client))
+	r = &AccountRegistry{Repo: "platform"}
+	assert.EqualError(t, r.Fetch(noContext, client), "Account registry needs a repo and path")
+}
+
+func TestValidateAliases(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone.yml", "testdata/.strithon-aliases.yml", `{"decision_id":"d1","result":{"allow":false,"denials":[{"account":"222222222222","environment":"prod"}]}}`)
+	defer ts.Close()
+
+	settings := &Settings{Registry: *testRegistry(t)}
+	a := &recordingAuthorizer{}
+	p := newFindPlugin(ts, WithSettings(settings), WithAuthorizer(a))
+	if _, err := p.Validate(noContext, findRequest(), ""); !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"111111111111", "222222222222", "333333333333"}, a.in.Input.Accounts)
+	assert.Equal(t, AuthEnvironment{Name: "prod", Account: "222222222222", Cloud: cloudAWS, Region: "us-east-1", Alias: "payments-prod", Owner: "payments"}, a.in.Input.Environments[1])
+
+	// denials name the canonical account
+	p = newFindPlugin(ts, WithSettings(settings))
+	d, err := p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"account 222222222222 (environment prod)"}, d.Reasons())
+	}
+}
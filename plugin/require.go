@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// defaultRequireDocs explains the .strithon.yml format
+	defaultRequireDocs = "https://github.com/bellyjay1005/drone-ci-config-extension#strithon-file-validation"
+
+	// missingExample is printed to show how a .strithon.yml starts
+	missingExample = `---
+kind: service
+metadata:
+  service:
+    id: <service id>
+    name: <service name>
+    team: <GitHub team>
+  environments:
+    - name: prod
+      cloud: aws
+      account: "<12 digit account id>"
+      region: us-east-1`
+)
+
+// RequireSettings makes a .strithon.yml mandatory before deploying, per
+// namespace or repository. Deploy steps of a repo without one are replaced,
+// other steps still run.
+type RequireSettings struct {
+	// Default applies when neither the repo nor its namespace is listed
+	Default bool `yaml:"default"`
+	// Namespaces maps an org or user to whether the file is required
+	Namespaces map[string]bool `yaml:"namespaces"`
+	// Repos maps a namespace/name slug to whether the file is required,
+	// winning over Namespaces
+	Repos map[string]bool `yaml:"repos"`
+	// Docs is linked from the step explaining how to add the file
+	Docs string `yaml:"docs"`
+}
+
+// Required returns true when the repository must have a .strithon.yml
+func (r *RequireSettings) Required(namespace, slug string) bool {
+	if required, ok := r.Repos[slug]; ok {
+		return required
+	}
+	if required, ok := r.Namespaces[namespace]; ok {
+		return required
+	}
+	return r.Default
+}
+
+// missingStep rewrites a deploy step so it explains how to add a
+// .strithon.yml, or the environments of an empty one, and fails
+func (d *DenialSettings) missingStep(step *yaml.Container, repo, docs string, empty bool) {
+	if docs == "" {
+		docs = defaultRequireDocs
+	}
+	problem := []string{
+		fmt.Sprintf("%s has no .strithon.yml. Deploys need one to check which accounts", repo),
+		"the repository may deploy to. Add it to the root of the repository:",
+	}
+	if empty {
+		problem = []string{
+			fmt.Sprintf("The .strithon.yml of %s lists no environments. Deploys need them to", repo),
+			"check which accounts the repository may deploy to. List them like this:",
+		}
+	}
+	lines := append([]string{
+		"================================================================",
+		" DEPLOY BLOCKED: " + step.Name,
+		"================================================================",
+	}, problem...)
+	lines = append(lines,
+		"",
+		missingExample,
+		"",
+		"Steps that don't deploy still run.",
+		fmt.Sprintf("See %s for the full format.", docs),
+		"================================================================",
+	)
+	d.blockStep(step, strings.Join(lines, "\n"))
+}
+
+// injectMissing replaces the deploy steps of a pipeline and returns their
+// original names
+func injectMissing(pipe *yaml.Pipeline, repo string, build *drone.Build, settings *Settings, empty bool) []string {
+	names := []string{}
+	for _, step := range pipe.Steps {
+		if deploy, _ := deployStep(step, build, nil, settings.Matchers); !deploy {
+			continue
+		}
+		names = append(names, step.Name)
+		renameStep(pipe, step, fmt.Sprintf("%s-unauthorized", step.Name))
+		settings.Denial.missingStep(step, repo, settings.Require.Docs, empty)
+	}
+	return names
+}
+
+// replaceMissing replaces the deploy steps of every pipeline of a repo that
+// is required to have a .strithon.yml but has none, or one listing no
+// environments when empty is set
+func (p *Plugin) replaceMissing(ctx context.Context, content string, req *config.Request, empty bool) (string, []string, error) {
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
+	}
+	replaced := []string{}
+	for _, r := range manifest.Resources {
+		if v, ok := r.(*yaml.Pipeline); ok {
+			replaced = append(replaced, injectMissing(v, req.Repo.Slug, &req.Build, p.settings, empty)...)
+		}
+	}
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, replaced, nil
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	dyaml "github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequired(t *testing.T) {
+	r := RequireSettings{
+		Namespaces: map[string]bool{"org": true},
+		Repos:      map[string]bool{"org/legacy": false},
+	}
+	assert.True(t, r.Required("org", "org/name"))
+	assert.False(t, r.Required("org", "org/legacy"))
+	assert.False(t, r.Required("other", "other/name"))
+
+	r.Default = true
+	assert.True(t, r.Required("other", "other/name"))
+}
+
+func TestFindMissingStrithonYml(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "", "")
+	defer ts.Close()
+
+	// without the requirement the pipeline is left alone
+	p := newFindPlugin(ts)
+	res, err := p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.NotContains(t, res.Data, "unauthorized")
+	}
+
+	var buf bytes.Buffer
+	settings := &Settings{Require: RequireSettings{Namespaces: map[string]bool{"org": true}}}
+	p = newFindPlugin(ts, WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err = p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	manifest, err := dyaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pipe := manifest.Resources[0].(*dyaml.Pipeline)
+	names := []string{}
+	for _, step := range pipe.Steps {
+		names = append(names, step.Name)
+	}
+	// tests still run, deploys are replaced
+	assert.Equal(t, []string{"test", "deploy-qa-unauthorized", "deploy-prod-unauthorized", "smoke-prod"}, names)
+	assert.Equal(t, []string{"deploy-prod-unauthorized"}, pipe.Steps[3].DependsOn)
+	assert.Contains(t, pipe.Steps[1].Commands[0], "org/name has no .strithon.yml")
+	assert.Contains(t, pipe.Steps[1].Commands[0], "kind: service")
+	assert.Equal(t, "exit 1", pipe.Steps[1].Commands[1])
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, auditMissing, e.Decision)
+		assert.Equal(t, []string{"deploy-qa", "deploy-prod"}, e.Steps)
+	}
+}
+
+func TestFindEmptyStrithonYml(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-no-environ.yml", "")
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	settings := &Settings{Require: RequireSettings{Namespaces: map[string]bool{"org": true}}}
+	p := newFindPlugin(ts, WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	res, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, res.Data, "deploy-qa-unauthorized")
+	assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+	assert.Contains(t, res.Data, "The .strithon.yml of org/name lists no environments")
+
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, auditMissing, e.Decision)
+		assert.Equal(t, []string{"deploy-qa", "deploy-prod"}, e.Steps)
+	}
+
+	// without the requirement it is allowed
+	p = newFindPlugin(ts)
+	res, err = p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.NotContains(t, res.Data, "unauthorized")
+	}
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+const (
+	// eventCron and eventCustom are build events drone-go has no
+	// constant for
+	eventCron   = "cron"
+	eventCustom = "custom"
+)
+
+// knownEvents are the build events a deploy rule may allow
+var knownEvents = []string{
+	drone.EventPush,
+	drone.EventPullRequest,
+	drone.EventTag,
+	drone.EventPromote,
+	drone.EventRollback,
+	eventCron,
+	eventCustom,
+}
+
+// DeployRule limits the builds that may deploy to an environment. Empty
+// lists allow anything.
+type DeployRule struct {
+	// Branches are globs of the branches that may deploy, * matches /
+	Branches []string `yaml:"branches,omitempty"`
+	// Events are the build events that may deploy
+	Events []string `yaml:"events,omitempty"`
+	// Targets are globs of the promotion targets that may deploy
+	Targets []string `yaml:"targets,omitempty"`
+}
+
+// check returns why the build may not deploy to the environment, or an
+// empty string when it may
+func (r *DeployRule) check(build *drone.Build, env string) string {
+	if len(r.Events) > 0 && !contains(r.Events, build.Event) {
+		return fmt.Sprintf("%s builds may not deploy to %s", build.Event, env)
+	}
+	// tags are not on a branch, pull requests are checked by their head
+	// branch
+	branch := buildBranch(build)
+	if len(r.Branches) > 0 && build.Event != drone.EventTag && !globAny(r.Branches, branch) {
+		return fmt.Sprintf("branch %s may not deploy to %s", branch, env)
+	}
+	if len(r.Targets) > 0 && build.Event == drone.EventPromote && !globAny(r.Targets, build.Deploy) {
+		return fmt.Sprintf("promotion target %s may not deploy to %s", build.Deploy, env)
+	}
+	return ""
+}
+
+// validate checks every event of the rule is known
+func (r *DeployRule) validate() error {
+	for _, event := range r.Events {
+		if !contains(knownEvents, event) {
+			return fmt.Errorf("Unknown event %s, expected one of %s", event, strings.Join(knownEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// RestrictionSettings are the central deploy rules of the environments.
+// They apply next to the rules of .strithon.yml, which can only narrow them.
+type RestrictionSettings struct {
+	// Environments maps environment name globs to a rule, every matching
+	// rule applies
+	Environments map[string]DeployRule `yaml:"environments"`
+}
+
+// Validate checks the events of every rule
+func (r *RestrictionSettings) Validate() error {
+	for _, rule := range r.Environments {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rules returns the central rules matching any name of an environment, and
+// its .strithon.yml rule
+func (r *RestrictionSettings) rules(env Environment, names []string) []DeployRule {
+	rules := []DeployRule{}
+	for pattern, rule := range r.Environments {
+		for _, name := range names {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+				rules = append(rules, rule)
+				break
+			}
+		}
+	}
+	if env.Deploy != nil {
+		rules = append(rules, *env.Deploy)
+	}
+	return rules
+}
+
+// checkRestrictions denies the environments the build may not deploy to.
+// Central rules match the name of an environment in the build or the names
+// its account has on the default branch.
+func (p *Plugin) checkRestrictions(ctx context.Context, build *drone.Build, service *bellyjay1005, in *AuthRequest, decision *Decision, trusted *trust) {
+	envs := map[string]Environment{}
+	for _, env := range service.Metadata.Environments {
+		envs[env.Name] = env
+	}
+	for _, env := range in.Input.Environments {
+		names := []string{env.Name}
+		if trusted != nil {
+			names = trusted.environmentNames(env)
+		}
+		reason := ""
+		for _, rule := range p.settings.Restrictions.rules(envs[env.Name], names) {
+			if reason = rule.check(build, env.Name); reason != "" {
+				break
+			}
+		}
+		if reason == "" {
+			continue
+		}
+		logger(ctx).WithField("environment", env.Name).Warnf("Deploy restricted: %s", reason)
+		if !contains(decision.Restricted, env.Name) {
+			decision.Restricted = append(decision.Restricted, env.Name)
+		}
+		decision.Denials = append(decision.Denials, Denial{
+			Account:     env.Account,
+			Environment: env.Name,
+			Reason:      reason,
+			OU:          env.OU,
+		})
+	}
+	if len(decision.Restricted) > 0 {
+		decision.Allowed = false
+	}
+}
+
+// withholdTokens removes the api tokens of the restricted environments from
+// every step and their secrets from the manifest. It returns the secrets that
+// were removed.
+func (p *Plugin) withholdTokens(ctx context.Context, content string, envs []string) (string, []string, error) {
+	names := map[string]bool{}
+	for _, env := range envs {
+		names[tokenSecretName(strings.ToLower(env))] = true
+	}
+	manifest, err := parseManifest(ctx, content)
+	if err != nil {
+		logger(ctx).Errorf("Error parsing drone config: %s", err)
+		return "", nil, err
+	}
+	removed := []string{}
+	resources := manifest.Resources[:0]
+	for _, r := range manifest.Resources {
+		switch v := r.(type) {
+		case *yaml.Pipeline:
+			for _, c := range append(append([]*yaml.Container{}, v.Services...), v.Steps...) {
+				for key, variable := range c.Environment {
+					if names[key] || (variable != nil && names[variable.Secret]) {
+						delete(c.Environment, key)
+					}
+				}
+			}
+		case *yaml.Secret:
+			if names[v.Name] {
+				removed = append(removed, v.Name)
+				continue
+			}
+		}
+		resources = append(resources, r)
+	}
+	manifest.Resources = resources
+	newContent, _ := manifest.Encode()
+	content = fmt.Sprintf("---\n%s", string(newContent))
+	return content, removed, nil
+}
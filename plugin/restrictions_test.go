@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeployRule(t *testing.T) {
+	rule := DeployRule{
+		Branches: []string{"main", "release/*"},
+		Events:   []string{"push", "tag", "promote"},
+		Targets:  []string{"prod*"},
+	}
+	cases := []struct {
+		build  drone.Build
+		reason string
+	}{
+		{build: drone.Build{Event: "push", Target: "main"}},
+		{build: drone.Build{Event: "push", Target: "release/1.2"}},
+		{build: drone.Build{Event: "tag", Target: "refs/tags/v1.2.0"}},
+		{build: drone.Build{Event: "promote", Target: "main", Deploy: "production"}},
+		{
+			build:  drone.Build{Event: "pull_request", Target: "main"},
+			reason: "pull_request builds may not deploy to prod",
+		},
+		{
+			build:  drone.Build{Event: "push", Target: "feature/login"},
+			reason: "branch feature/login may not deploy to prod",
+		},
+		{
+			build:  drone.Build{Event: "promote", Target: "main", Deploy: "staging"},
+			reason: "promotion target staging may not deploy to prod",
+		},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.reason, rule.check(&c.build, "prod"), c.build.Event+" "+c.build.Target)
+	}
+	assert.Equal(t, "", (&DeployRule{}).check(&drone.Build{Event: "cron"}, "prod"))
+
+	// pull requests are checked by the branch they come from
+	pr := DeployRule{Branches: []string{"main"}}
+	assert.Equal(t, "branch feature/x may not deploy to prod", pr.check(&drone.Build{Event: "pull_request", Source: "feature/x", Target: "main"}, "prod"))
+	assert.Equal(t, "", pr.check(&drone.Build{Event: "pull_request", Source: "main", Target: "main"}, "prod"))
+}
+
+func TestRestrictionSettings(t *testing.T) {
+	r := RestrictionSettings{Environments: map[string]DeployRule{
+		"prod*": {Events: []string{"promote"}},
+		"*":     {Events: []string{"push", "promote", "cron"}},
+	}}
+	assert.NoError(t, r.Validate())
+	assert.Len(t, r.rules(Environment{Name: "Prod-EU"}, []string{"Prod-EU"}), 2)
+	assert.Len(t, r.rules(Environment{Name: "qa", Deploy: &DeployRule{}}, []string{"qa"}), 2)
+	// a renamed environment keeps the rules of its default branch name
+	assert.Len(t, r.rules(Environment{Name: "prd"}, []string{"prd", "prod"}), 2)
+
+	r.Environments["qa"] = DeployRule{Events: []string{"merge"}}
+	assert.EqualError(t, r.Validate(), "Unknown event merge, expected one of push, pull_request, tag, promote, rollback, cron, custom")
+
+	_, err := ParseSettings([]byte("restrictions:\n  environments:\n    prod: {events: [deploy]}\n"))
+	assert.Error(t, err)
+}
+
+func TestParseDeployRule(t *testing.T) {
+	b, _ := ioutil.ReadFile("testdata/.strithon-restricted.yml")
+	m, err := ParsestrithonYml(string(b))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &DeployRule{Events: []string{"push", "promote"}, Branches: []string{"master", "release/*"}}, m.Metadata.Environments[0].Deploy)
+
+	service := "kind: service\nmetadata:\n  service: {id: a, name: b, team: c}\n  environments:\n"
+	_, err = ParsestrithonYml(service + "    - {name: qa, cloud: aws, account: \"111111111111\", region: us-east-1, deploy: {events: [merge]}}\n")
+	assert.EqualError(t, err, `line 5, column 92: metadata.environments[0].deploy.events[0] must be one of push, pull_request, tag, promote, rollback, cron, custom, not "merge"`)
+}
+
+func TestFindRestrictions(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-restricted.yml", `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Restrictions: RestrictionSettings{Environments: map[string]DeployRule{
+		"prod": {Branches: []string{"main"}},
+	}}}
+	p := newFindPlugin(ts, WithSettings(settings))
+
+	// central rules: master may not deploy to prod
+	res, err := p.Find(noContext, findRequest())
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-prod-unauthorized")
+		assert.Contains(t, res.Data, "branch master may not deploy to prod")
+		assert.NotContains(t, res.Data, "deploy-qa-unauthorized")
+	}
+
+	// .strithon.yml rules: pull requests may not deploy to qa
+	req := findRequest()
+	req.Build.Event = "pull_request"
+	settings.Restrictions.Environments = nil
+	res, err = p.Find(noContext, req)
+	if assert.NoError(t, err) {
+		assert.Contains(t, res.Data, "deploy-qa-unauthorized")
+		assert.Contains(t, res.Data, "pull_request builds may not deploy to qa")
+		assert.NotContains(t, res.Data, "deploy-prod-unauthorized")
+	}
+
+	// no step gets the token of a restricted environment
+	req = findRequest()
+	req.Build.Target = "feature/x"
+	res, err = p.Find(noContext, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, res.Data, "deploy-qa-unauthorized")
+	manifest, err := yaml.Parse(strings.NewReader(res.Data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, r := range manifest.Resources {
+		switch v := r.(type) {
+		case *yaml.Pipeline:
+			for _, step := range v.Steps {
+				assert.NotContains(t, step.Environment, tokenSecretName("qa"), step.Name)
+				if step.Name == "test" {
+					assert.Contains(t, step.Environment, tokenSecretName("pr"))
+				}
+			}
+		case *yaml.Secret:
+			assert.NotEqual(t, tokenSecretName("qa"), v.Name)
+		}
+	}
+}
+
+func TestValidateRestrictionsRenamedEnvironment(t *testing.T) {
+	// the built commit renames prod but keeps its account
+	const after = "a1afc9b699274831f841d1fd8ace0f5e91d92711"
+	ts := newFindServerRefs(t, "testdata/.drone-environments.yml", map[string]string{
+		"":    "testdata/.strithon-multi-env.yml",
+		after: "testdata/.strithon-renamed.yml",
+	}, `{"result":true,"decision_id":"d1"}`)
+	defer ts.Close()
+
+	settings := &Settings{Restrictions: RestrictionSettings{Environments: map[string]DeployRule{
+		"prod": {Branches: []string{"main"}},
+	}}}
+	p := newFindPlugin(ts, WithSettings(settings), WithTeamMembership(&fakeTeams{}))
+	req := findRequest()
+	req.Repo.Branch = "main"
+	d, err := p.Validate(noContext, req, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"account 222222222222 (environment prd): branch master may not deploy to prd"}, d.Reasons())
+		assert.Equal(t, []string{"prd"}, d.Restricted)
+	}
+}
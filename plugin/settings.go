@@ -0,0 +1,170 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// policyRemote asks the auth api for every decision
+	policyRemote = "remote"
+
+	// policyLocal evaluates the rules in-process
+	policyLocal = "local"
+
+	// defaultAuthTimeout bounds auth api calls when no timeout is set
+	defaultAuthTimeout = 10 * time.Second
+
+	// defaultBreakerFailures opens the breaker when no threshold is set
+	defaultBreakerFailures = 3
+
+	// defaultBreakerCooldown is used when no cooldown is set
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// Settings holds the extension configuration loaded at start up
+type Settings struct {
+	Policy PolicySettings `yaml:"policy"`
+	Outage OutageSettings `yaml:"outage"`
+	// Matchers decide which steps are deploy steps. When set, deploy steps
+	// only receive the token of the environment they deploy to.
+	Matchers []StepMatcher `yaml:"matchers"`
+	// Denial configures the step that replaces a denied deploy step
+	Denial DenialSettings `yaml:"denial"`
+	// Enforcement switches repositories between enforce and audit mode
+	Enforcement EnforcementSettings `yaml:"enforcement"`
+	// Shadow is a candidate policy compared against the live one
+	Shadow ShadowSettings `yaml:"shadow"`
+	// Audit selects where audit records are written
+	Audit AuditSettings `yaml:"audit"`
+	// Tracing exports spans to an OTLP collector
+	Tracing TracingSettings `yaml:"tracing"`
+	// CloudFormation configures the generated stack deploy steps
+	CloudFormation CloudFormationSettings `yaml:"cloudformation"`
+	// Organizations maps AWS Organizations OUs to their accounts
+	Organizations OrganizationSettings `yaml:"organizations"`
+	// Registry maps account aliases to account ids
+	Registry AccountRegistry `yaml:"registry"`
+	// Ownership limits protected environments to the owners of a service
+	Ownership OwnershipSettings `yaml:"ownership"`
+	// Notify announces denials and policy errors
+	Notify NotifySettings `yaml:"notify"`
+	// Require makes a .strithon.yml mandatory before deploying
+	Require RequireSettings `yaml:"require"`
+	// Restrictions limit the builds that may deploy to each environment
+	Restrictions RestrictionSettings `yaml:"restrictions"`
+	// Guardrails flag risky pipeline features
+	Guardrails GuardrailSettings `yaml:"guardrails"`
+	// Mirrors rewrite pipeline images to internal mirrors
+	Mirrors MirrorSettings `yaml:"mirrors"`
+}
+
+// PolicySettings selects how account permissions are decided
+type PolicySettings struct {
+	// Mode is either remote (the default) or local
+	Mode string `yaml:"mode"`
+	// Endpoint overrides the auth api endpoint used in remote mode
+	Endpoint string `yaml:"endpoint"`
+	// File is a local rules file used in local mode
+	File string `yaml:"file"`
+	// Repo is an owner/name repository holding the rules in local mode
+	Repo string `yaml:"repo"`
+	// Path is the rules file in Repo
+	Path string `yaml:"path"`
+	// Ref is the branch, tag or commit of Repo to read
+	Ref string `yaml:"ref"`
+}
+
+// ParseSettings loads the extension settings from yaml
+func ParseSettings(b []byte) (*Settings, error) {
+	var settings Settings
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return nil, err
+	}
+	if err := settings.Outage.Validate(); err != nil {
+		return nil, err
+	}
+	for _, m := range settings.Matchers {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := settings.Denial.Validate(); err != nil {
+		return nil, err
+	}
+	if err := settings.Enforcement.Validate(); err != nil {
+		return nil, err
+	}
+	if err := settings.Restrictions.Validate(); err != nil {
+		return nil, err
+	}
+	if err := settings.Guardrails.Validate(); err != nil {
+		return nil, err
+	}
+	if err := settings.Mirrors.Validate(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// LoadSettings loads the extension settings from a file, an empty path
+// returns the defaults
+func LoadSettings(file string) (*Settings, error) {
+	if file == "" {
+		return &Settings{}, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := ParseSettings(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := settings.Organizations.load(); err != nil {
+		return nil, err
+	}
+	if err := settings.Registry.load(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// NewAuthorizer builds the Authorizer selected by the policy settings
+func (s *Settings) NewAuthorizer(ctx context.Context, authEndpoint string, client *github.Client) (Authorizer, error) {
+	switch s.Policy.Mode {
+	case "", policyRemote:
+		if s.Policy.Endpoint != "" {
+			authEndpoint = s.Policy.Endpoint
+		}
+		timeout := s.Outage.Timeout
+		if timeout == 0 {
+			timeout = defaultAuthTimeout
+		}
+		failures := s.Outage.Failures
+		if failures == 0 {
+			failures = defaultBreakerFailures
+		}
+		cooldown := s.Outage.Cooldown
+		if cooldown == 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		return NewCircuitBreaker(NewRemoteAuthorizer(authEndpoint, timeout), failures, cooldown), nil
+	case policyLocal:
+		if s.Policy.File != "" {
+			return LoadPolicyFile(s.Policy.File)
+		}
+		parts := strings.SplitN(s.Policy.Repo, "/", 2)
+		if len(parts) != 2 || s.Policy.Path == "" {
+			return nil, fmt.Errorf("Local policy needs a file or a repo and path")
+		}
+		return FetchPolicyBundle(ctx, client, parts[0], parts[1], s.Policy.Path, s.Policy.Ref)
+	}
+	return nil, fmt.Errorf("Unknown policy mode %s", s.Policy.Mode)
+}
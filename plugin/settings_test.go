@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSettings(t *testing.T) {
+	settings, err := LoadSettings("")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", settings.Policy.Mode)
+	}
+
+	settings, err = LoadSettings("testdata/settings.yml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "local", settings.Policy.Mode)
+	}
+
+	_, err = LoadSettings("testdata/missing.yml")
+	assert.Error(t, err)
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		settings Settings
+		local    bool
+		err      bool
+	}{
+		{
+			name: "remote by default",
+		},
+		{
+			name:     "local file",
+			settings: Settings{Policy: PolicySettings{Mode: "local", File: "testdata/policy.yml"}},
+			local:    true,
+		},
+		{
+			name:     "local without a source",
+			settings: Settings{Policy: PolicySettings{Mode: "local"}},
+			err:      true,
+		},
+		{
+			name:     "unknown mode",
+			settings: Settings{Policy: PolicySettings{Mode: "opa"}},
+			err:      true,
+		},
+	}
+	for _, c := range cases {
+		a, err := c.settings.NewAuthorizer(noContext, "https://auth.example.com", nil)
+		if (err == nil) == c.err {
+			t.Errorf("%s: expected error to be %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		_, local := a.(*LocalPolicy)
+		assert.Equal(t, c.local, local, c.name)
+	}
+}
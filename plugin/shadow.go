@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultShadowTimeout bounds how long a config request waits for the
+// candidate policy when no timeout is set
+const defaultShadowTimeout = 2 * time.Second
+
+// ShadowSettings configures a candidate policy evaluated next to the live
+// one. Its answer never changes the build.
+type ShadowSettings struct {
+	// Endpoint is the base url of the candidate auth api
+	Endpoint string `yaml:"endpoint"`
+	// Path is the candidate rule, the live rule path unless set
+	Path string `yaml:"path"`
+	// Timeout bounds the candidate call
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// WaitTimeout returns the timeout of the candidate call, which also bounds
+// the wait for a pending comparison
+func (s *ShadowSettings) WaitTimeout() time.Duration {
+	if s.Timeout == 0 {
+		return defaultShadowTimeout
+	}
+	return s.Timeout
+}
+
+// NewShadowAuthorizer returns the candidate Authorizer, or nil when no
+// candidate is configured
+func (s *Settings) NewShadowAuthorizer() Authorizer {
+	if s.Shadow.Endpoint == "" {
+		return nil
+	}
+	a := NewRemoteAuthorizer(s.Shadow.Endpoint, s.Shadow.WaitTimeout()).(*remoteAuthorizer)
+	if s.Shadow.Path != "" {
+		a.path = s.Shadow.Path
+	}
+	a.upstream = upstreamShadow
+	return a
+}
+
+// shadowResult is the answer of the candidate policy
+type shadowResult struct {
+	res *AuthResponse
+	err error
+}
+
+// startShadow asks the candidate policy in the background. The call keeps
+// the request id and trace of ctx but outlives the config request.
+func startShadow(ctx context.Context, a Authorizer, in *AuthRequest, token string) <-chan shadowResult {
+	if a == nil {
+		return nil
+	}
+	detached := trace.ContextWithSpanContext(WithRequestID(context.Background(), RequestID(ctx)), trace.SpanContextFromContext(ctx))
+	out := make(chan shadowResult, 1)
+	go func() {
+		res, err := a.Authorize(detached, in, token)
+		out <- shadowResult{res: res, err: err}
+	}()
+	return out
+}
+
+// recordShadow compares the candidate answer with a copy of the live
+// decision in the background and records any disagreement, so a slow
+// candidate never holds up the config request
+func (p *Plugin) recordShadow(ctx context.Context, req *config.Request, in *AuthRequest, decision *Decision, shadow <-chan shadowResult) {
+	if shadow == nil {
+		return
+	}
+	// ownership and deploy rules add to the live decision afterwards
+	live := *decision
+	live.Denials = append([]Denial(nil), decision.Denials...)
+	repo, commit, sender, event := req.Repo.Slug, req.Build.After, req.Build.Sender, req.Build.Event
+	p.shadows.Add(1)
+	go func() {
+		defer p.shadows.Done()
+		e := compareShadow(in, &live, shadow)
+		if e == nil {
+			return
+		}
+		e.Repo, e.Commit, e.Sender, e.Event = repo, commit, sender, event
+		p.auditor.Record(e)
+	}()
+}
+
+// WaitShadows blocks until every pending shadow comparison is recorded, or
+// until ctx is done
+func (p *Plugin) WaitShadows(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.shadows.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// compareShadow waits for the candidate answer and returns an audit event
+// when it disagrees with the live decision, nil otherwise
+func compareShadow(in *AuthRequest, live *Decision, shadow <-chan shadowResult) *AuditEvent {
+	if shadow == nil || live == nil || live.Outage {
+		return nil
+	}
+	result := <-shadow
+	if result.err != nil {
+		logrus.Debugf("Candidate policy unavailable for %s: %v", in.Input.Repo, result.err)
+		return nil
+	}
+	candidate := NewDecision(in, result.res)
+	liveDenied := denialKeys(live)
+	candidateDenied := denialKeys(candidate)
+	if live.Allowed == candidate.Allowed && fmt.Sprint(liveDenied) == fmt.Sprint(candidateDenied) {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"repo":                  in.Input.Repo,
+		"live_decision_id":      live.ID,
+		"candidate_decision_id": candidate.ID,
+	}).Warn("Candidate policy disagrees with the live policy")
+	event := &AuditEvent{Kind: auditShadow}
+	event.setDecision(live, enforcementEnforce)
+	event.Candidate = &AuditCandidate{
+		DecisionID: candidate.ID,
+		Allowed:    candidate.Allowed,
+		Denials:    candidateDenied,
+	}
+	return event
+}
+
+// denialKeys returns the sorted account/environment pairs of the denials
+func denialKeys(d *Decision) []string {
+	keys := []string{}
+	for _, denial := range d.Denials {
+		keys = append(keys, fmt.Sprintf("%s/%s", denial.Account, denial.Environment))
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticAuthorizer always gives the same answer
+type staticAuthorizer struct {
+	res *AuthResponse
+	err error
+}
+
+func (s *staticAuthorizer) Authorize(ctx context.Context, in *AuthRequest, token string) (*AuthResponse, error) {
+	return s.res, s.err
+}
+
+func TestCompareShadow(t *testing.T) {
+	in := &AuthRequest{}
+	in.Input.Repo = "github.com/org/name"
+	in.Input.Accounts = []string{"111111111111", "222222222222"}
+	in.Input.Environments = []AuthEnvironment{
+		{Name: "qa", Account: "111111111111"},
+		{Name: "prod", Account: "222222222222"},
+	}
+	live := NewDecision(in, &AuthResponse{Result: AuthResult{Allow: true}, DecisionID: "live"})
+
+	cases := []struct {
+		name      string
+		candidate Authorizer
+		live      *Decision
+		disagree  bool
+	}{
+		{
+			name:      "same answer",
+			candidate: &staticAuthorizer{res: &AuthResponse{Result: AuthResult{Allow: true}, DecisionID: "candidate"}},
+			live:      live,
+		},
+		{
+			name: "candidate denies prod",
+			candidate: &staticAuthorizer{res: &AuthResponse{
+				Result:     AuthResult{Denials: []Denial{{Account: "222222222222", Environment: "prod"}}},
+				DecisionID: "candidate",
+			}},
+			live:     live,
+			disagree: true,
+		},
+		{
+			name:      "candidate unavailable",
+			candidate: &staticAuthorizer{err: ErrAuthUnavailable},
+			live:      live,
+		},
+		{
+			name:      "no candidate",
+			candidate: nil,
+			live:      live,
+		},
+		{
+			name:      "live outage is not compared",
+			candidate: &staticAuthorizer{res: &AuthResponse{Result: AuthResult{Allow: true}}},
+			live:      &Decision{Outage: true},
+		},
+	}
+	for _, c := range cases {
+		shadow := startShadow(noContext, c.candidate, in, "")
+		assert.Equal(t, c.disagree, compareShadow(in, c.live, shadow) != nil, c.name)
+	}
+}
+
+func TestValidateShadowDoesNotChangeDecision(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", `{"result":true,"decision_id":"live"}`)
+	defer ts.Close()
+
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/data/demo/drone/allow_next", r.URL.Path)
+		w.Write([]byte(prodDenied))
+	}))
+	defer candidate.Close()
+
+	settings := &Settings{Shadow: ShadowSettings{Endpoint: candidate.URL, Path: "/v1/data/demo/drone/allow_next"}}
+	p := newFindPlugin(ts, WithShadowAuthorizer(settings.NewShadowAuthorizer()), WithSettings(settings))
+	decision, err := p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) {
+		assert.True(t, decision.Allowed)
+		assert.Equal(t, "live", decision.ID)
+	}
+	assert.Nil(t, (&Settings{}).NewShadowAuthorizer())
+}
+
+func TestValidateShadowInBackground(t *testing.T) {
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", `{"result":true,"decision_id":"live"}`)
+	defer ts.Close()
+
+	// the candidate only answers once Validate has returned
+	release := make(chan struct{})
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(prodDenied))
+	}))
+	defer candidate.Close()
+
+	var buf bytes.Buffer
+	settings := &Settings{Shadow: ShadowSettings{Endpoint: candidate.URL}}
+	p := newFindPlugin(ts, WithShadowAuthorizer(settings.NewShadowAuthorizer()), WithSettings(settings), WithAuditor(NewAuditor(NewWriterSink(&buf))))
+	decision, err := p.Validate(noContext, findRequest(), "")
+	if assert.NoError(t, err) {
+		assert.True(t, decision.Allowed)
+	}
+	assert.Empty(t, buf.String())
+
+	// waiting gives up with the context
+	ctx, cancel := context.WithTimeout(noContext, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.WaitShadows(ctx))
+
+	close(release)
+	assert.NoError(t, p.WaitShadows(noContext))
+	var e AuditEvent
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &e)) {
+		assert.Equal(t, auditShadow, e.Kind)
+		assert.Equal(t, "org/name", e.Repo)
+		assert.Equal(t, "octocat", e.Sender)
+		assert.False(t, e.Candidate.Allowed)
+	}
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+)
+
+// markerVariable explicitly tags a step with the environment it deploys to
+const markerVariable = "STRITHON_ENVIRONMENT"
+
+// environVariables are the conventional variables a step uses to say which
+// environment it deploys to, checked in order
+var environVariables = []string{"ENVIRON", "ENVIRONMENT", "DEPLOY_ENV", "DEPLOY_ENVIRONMENT"}
+
+// stepEnvironment returns the environment a step targets, or "" when it
+// cannot be worked out. The explicit marker wins over ENVIRON-style
+// variables, which win over the promotion target and the branch filter.
+// When envs is not empty only those names are recognised, and a marker
+// naming any other environment leaves the step unmapped.
+func stepEnvironment(step *yaml.Container, build *drone.Build, envs []string) string {
+	if env := variableEnvironment(step, markerVariable); env != "" {
+		return knownEnvironment(env, envs)
+	}
+	for _, name := range environVariables {
+		if env := knownEnvironment(variableEnvironment(step, name), envs); env != "" {
+			return env
+		}
+	}
+
+	// a promotion names the environment it deploys to
+	if build != nil && build.Deploy != "" && step.When.Target.Includes(build.Deploy) {
+		if env := knownEnvironment(build.Deploy, envs); env != "" {
+			return env
+		}
+	}
+	if env := conditionEnvironment(step.When.Target, envs); env != "" {
+		return env
+	}
+	return conditionEnvironment(step.When.Branch, envs)
+}
+
+// buildBranch returns the branch whose code the build runs, the head branch
+// of a pull request rather than the branch it targets
+func buildBranch(build *drone.Build) string {
+	if build.Event == drone.EventPullRequest && build.Source != "" {
+		return build.Source
+	}
+	return build.Target
+}
+
+// variableEnvironment returns the lowercased literal value of a step variable
+func variableEnvironment(step *yaml.Container, name string) string {
+	v, ok := step.Environment[name]
+	if !ok || v == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(v.Value))
+}
+
+// conditionEnvironment returns the environment named by a condition, as long
+// as the condition only names one known environment
+func conditionEnvironment(cond yaml.Condition, envs []string) string {
+	if len(envs) == 0 {
+		return ""
+	}
+	found := ""
+	for _, include := range cond.Include {
+		env := knownEnvironment(include, envs)
+		if env == "" {
+			continue
+		}
+		if found != "" && found != env {
+			return ""
+		}
+		found = env
+	}
+	return found
+}
+
+// knownEnvironment lowercases the name and checks it against the list of
+// environments, any name is accepted when the list is empty
+func knownEnvironment(name string, envs []string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || len(envs) == 0 {
+		return name
+	}
+	for _, env := range envs {
+		if strings.ToLower(env) == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// renameStep renames a step and updates every depends_on that refers to it
+// so the pipeline graph stays valid
+func renameStep(pipe *yaml.Pipeline, step *yaml.Container, name string) {
+	old := step.Name
+	step.Name = name
+	for _, s := range pipe.Steps {
+		for i, dep := range s.DependsOn {
+			if dep == old {
+				s.DependsOn[i] = name
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepEnvironment(t *testing.T) {
+	envs := []string{"qa", "prod"}
+	cases := []struct {
+		name  string
+		step  *yaml.Container
+		build *drone.Build
+		envs  []string
+		want  string
+	}{
+		{
+			name: "explicit marker wins",
+			step: &yaml.Container{
+				Environment: map[string]*yaml.Variable{
+					"STRITHON_ENVIRONMENT": {Value: "prod"},
+					"ENVIRON":              {Value: "qa"},
+				},
+			},
+			envs: envs,
+			want: "prod",
+		},
+		{
+			name: "unknown marker value",
+			step: &yaml.Container{
+				Environment: map[string]*yaml.Variable{
+					"STRITHON_ENVIRONMENT": {Value: "dev"},
+					"ENVIRON":              {Value: "qa"},
+				},
+			},
+			envs: envs,
+			want: "",
+		},
+		{
+			name: "environ variable",
+			step: &yaml.Container{
+				Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "QA"}},
+			},
+			envs: envs,
+			want: "qa",
+		},
+		{
+			name: "unknown environ value",
+			step: &yaml.Container{
+				Environment: map[string]*yaml.Variable{"ENVIRON": {Value: "staging"}},
+			},
+			envs: envs,
+			want: "",
+		},
+		{
+			name: "promotion target",
+			step: &yaml.Container{
+				When: yaml.Conditions{Target: yaml.Condition{Include: []string{"qa", "prod"}}},
+			},
+			build: &drone.Build{Deploy: "prod"},
+			envs:  envs,
+			want:  "prod",
+		},
+		{
+			name: "branch named after the environment",
+			step: &yaml.Container{
+				When: yaml.Conditions{Branch: yaml.Condition{Include: []string{"prod"}}},
+			},
+			envs: envs,
+			want: "prod",
+		},
+		{
+			name: "branch not named after an environment",
+			step: &yaml.Container{
+				When: yaml.Conditions{Branch: yaml.Condition{Include: []string{"master"}}},
+			},
+			envs: envs,
+			want: "",
+		},
+		{
+			name: "branch is ambiguous",
+			step: &yaml.Container{
+				When: yaml.Conditions{Branch: yaml.Condition{Include: []string{"qa", "prod"}}},
+			},
+			envs: envs,
+			want: "",
+		},
+	}
+	for _, c := range cases {
+		got := stepEnvironment(c.step, c.build, c.envs)
+		assert.Equal(t, c.want, got, c.name)
+	}
+}
+
+func TestInjectWarningsDeniedEnvironment(t *testing.T) {
+	content, _ := ioutil.ReadFile("testdata/.drone-environments.yml")
+	manifest, err := yaml.Parse(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatalf("Error parsing test data: %v", err)
+	}
+	decision := &Decision{
+		ID:           "7d1c4f3e",
+		Environments: []string{"qa", "prod"},
+		Denials: []Denial{
+			{Account: "222222222222", Environment: "prod", Reason: "repo is not in the prod allow list"},
+		},
+	}
+	pipe := manifest.Resources[0].(*yaml.Pipeline)
+	injectWarnings(pipe, "name", "org", decision, &drone.Build{}, nil, nil)
+
+	steps := map[string]*yaml.Container{}
+	for _, step := range pipe.Steps {
+		steps[step.Name] = step
+	}
+	if assert.Contains(t, steps, "deploy-qa") {
+		assert.Equal(t, "plugins/aws-cloudformation:alpha", steps["deploy-qa"].Image)
+	}
+	if assert.Contains(t, steps, "deploy-prod-unauthorized") {
+		assert.Equal(t, "alpine", steps["deploy-prod-unauthorized"].Image)
+	}
+	assert.Equal(t, []string{"deploy-prod-unauthorized"}, steps["smoke-prod"].DependsOn)
+}
+
+func TestInjectWarningsUnknownMarker(t *testing.T) {
+	content, _ := ioutil.ReadFile("testdata/.drone-environments.yml")
+	manifest, err := yaml.Parse(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatalf("Error parsing test data: %v", err)
+	}
+	decision := &Decision{
+		Environments: []string{"qa", "prod"},
+		Denials:      []Denial{{Account: "222222222222", Environment: "prod"}},
+	}
+	pipe := manifest.Resources[0].(*yaml.Pipeline)
+	// a prod deploy claiming an environment the decision doesn't know
+	pipe.Steps[2].Environment[markerVariable] = &yaml.Variable{Value: "dev"}
+	names, _ := injectWarnings(pipe, "name", "org", decision, &drone.Build{}, nil, nil)
+	assert.Contains(t, names, "deploy-prod")
+}
+
+func TestBuildBranch(t *testing.T) {
+	assert.Equal(t, "main", buildBranch(&drone.Build{Event: drone.EventPush, Source: "main", Target: "main"}))
+	assert.Equal(t, "feature/x", buildBranch(&drone.Build{Event: drone.EventPullRequest, Source: "feature/x", Target: "main"}))
+	assert.Equal(t, "main", buildBranch(&drone.Build{Event: drone.EventPromote, Target: "main"}))
+}
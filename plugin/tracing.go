@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/drone/drone-yaml/yaml"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// tracerName identifies the spans of this package
+	tracerName = "github.com/bellyjay1005/aws-config-check-extension/plugin"
+
+	// serviceName is reported as the OpenTelemetry service.name
+	serviceName = "aws-config-check-extension"
+)
+
+// TracingSettings configures exporting spans to an OTLP collector. Spans
+// are dropped unless an endpoint is set.
+type TracingSettings struct {
+	// Endpoint is the host:port of the collector's OTLP/HTTP receiver
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain http
+	Insecure bool `yaml:"insecure"`
+}
+
+// StartTracing installs the OTLP exporter as the global tracer provider.
+// The returned function flushes pending spans, it does nothing when tracing
+// is off.
+func (s *Settings) StartTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if s.Tracing.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(s.Tracing.Endpoint)}
+	if s.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.ForceFlush, nil
+}
+
+// startSpan starts a span carrying the repo and build of the request
+func startSpan(ctx context.Context, name string, req *config.Request) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(requestAttributes(req)...))
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func requestAttributes(req *config.Request) []attribute.KeyValue {
+	if req == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("drone.repo", req.Repo.Slug),
+		attribute.Int64("drone.build.number", req.Build.Number),
+		attribute.String("drone.build.event", req.Build.Event),
+		attribute.String("drone.build.target", req.Build.Target),
+		attribute.String("drone.build.commit", req.Build.After),
+		attribute.String("drone.build.sender", req.Build.Sender),
+	}
+}
+
+// parseManifest parses a drone config inside a span
+func parseManifest(ctx context.Context, content string) (*yaml.Manifest, error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "yaml.Parse")
+	manifest, err := yaml.Parse(strings.NewReader(content))
+	endSpan(span, err)
+	return manifest, err
+}
+
+// tracingTransport sends the span context with every outbound request
+var tracingTransport = otelhttp.NewTransport(http.DefaultTransport)
+
+// tracedClient is the http client for calls that are not made through an
+// api client
+var tracedClient = &http.Client{Transport: tracingTransport}
+
+// tracingContext makes oauth2 clients created from ctx use the tracing
+// transport
+func tracingContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, tracedClient)
+}
+
+// contextTransport gives requests built without a context the one of the
+// config request, so clients that take no context still propagate it
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Context() == context.Background() {
+		r = r.WithContext(t.ctx)
+	}
+	return t.next.RoundTrip(r)
+}
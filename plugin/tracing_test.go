@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestFindTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	ts := newFindServer(t, "testdata/.drone-environments.yml", "testdata/.strithon-multi-env.yml", "")
+	defer ts.Close()
+
+	// the auth api receives the trace of the config request
+	traceparent := make(chan string, 1)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.Write([]byte(`{"result":true}`))
+	}))
+	defer auth.Close()
+
+	p := newFindPlugin(ts, WithAuthorizer(NewRemoteAuthorizer(auth.URL, 0)))
+	_, err := p.Find(noContext, findRequest())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if _, ok := spans[span.Name()]; !ok {
+			spans[span.Name()] = span
+		}
+	}
+	for _, name := range []string{"Find", "GetGithubFile", "GetAuth0APIKey", "EncryptData", "Validate", "yaml.Parse"} {
+		assert.Contains(t, spans, name)
+	}
+	find, validate := spans["Find"], spans["Validate"]
+	if find == nil || validate == nil {
+		return
+	}
+	assert.Equal(t, find.SpanContext().SpanID(), validate.Parent().SpanID())
+	for _, span := range spans {
+		assert.Equal(t, find.SpanContext().TraceID(), span.SpanContext().TraceID(), span.Name())
+	}
+	assert.Contains(t, find.Attributes(), attribute.String("drone.repo", "org/name"))
+	assert.Contains(t, find.Attributes(), attribute.String("strithon.decision", auditAllowed))
+	assert.Contains(t, <-traceparent, find.SpanContext().TraceID().String())
+}
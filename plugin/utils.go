@@ -3,9 +3,12 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/99designs/httpsignatures-go"
 	"github.com/aws/aws-lambda-go/events"
@@ -90,10 +93,12 @@ func GetSSMParam(region, tokenLocation string) (string, error) {
 	ssmClient, err := CreateSSMService(region)
 
 	// get token response
+	start := time.Now()
 	tokenRes, err := ssmClient.GetParameter(&ssm.GetParameterInput{
 		Name:           &tokenLocation,
 		WithDecryption: &decryption,
 	})
+	observeUpstream(upstreamSSM, start, err)
 	if err != nil {
 		return fmt.Sprintf("Error connecting to ssm: %s", err), nil
 	}
@@ -108,7 +113,7 @@ func CreateEnterpriseClient(ctx context.Context, server, token string) (*github.
 
 	// creates a github transport that authenticates
 	// enterprise-github http requests using the github access token.
-	trans := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+	trans := oauth2.NewClient(tracingContext(ctx), oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	))
 
@@ -124,7 +129,7 @@ func CreateEnterpriseClient(ctx context.Context, server, token string) (*github.
 func CreatePublicClient(ctx context.Context, server, token string) (*github.Client, error) {
 	// creates a github transport that authenticates
 	// public-github http requests using the github access token.
-	trans := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+	trans := oauth2.NewClient(tracingContext(ctx), oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	))
 
@@ -172,6 +177,12 @@ func HTTPError(message string, code int) events.APIGatewayProxyResponse {
 	}
 }
 
+// isNotFound returns true for GitHub api 404 errors
+func isNotFound(err error) bool {
+	var res *github.ErrorResponse
+	return errors.As(err, &res) && res.Response != nil && res.Response.StatusCode == http.StatusNotFound
+}
+
 // ConstructHost construct strings of endpoint and host
 func ConstructHost(env string) (string, string, error) {
 	envInsert := ""
@@ -200,6 +211,22 @@ func FromRequest(r events.APIGatewayProxyRequest) (*httpsignatures.Signature, er
 	return nil, httpsignatures.ErrorNoSignatureHeader
 }
 
+// LambdaRequestID returns the correlation id of an api gateway request,
+// falling back to the gateway's own request id
+func LambdaRequestID(req events.APIGatewayProxyRequest) string {
+	header := http.Header{}
+	for k, v := range req.Headers {
+		header.Set(k, v)
+	}
+	if id := RequestIDFromHeader(header); id != "" {
+		return id
+	}
+	if req.RequestContext.RequestID != "" {
+		return req.RequestContext.RequestID
+	}
+	return NewRequestID()
+}
+
 // AddCapHeader adds capitalization to Header Keys
 func AddCapHeader(req events.APIGatewayProxyRequest, header map[string][]string) (map[string][]string, error) {
 	for h, val := range req.Headers {